@@ -18,6 +18,7 @@ import (
 	"context"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 	"unsafe"
@@ -26,7 +27,10 @@ import (
 	"github.com/pingcap/tidb/executor/aggfuncs"
 	"github.com/pingcap/tidb/executor/internal/exec"
 	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/infoschema"
 	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/parser/model"
+	plannercore "github.com/pingcap/tidb/planner/core"
 	plannerutil "github.com/pingcap/tidb/planner/util"
 	"github.com/pingcap/tidb/sessionctx/variable"
 	"github.com/pingcap/tidb/tablecodec"
@@ -35,7 +39,9 @@ import (
 	"github.com/pingcap/tidb/util/memory"
 	"github.com/pingcap/tidb/util/mock"
 	"github.com/pingcap/tidb/util/ranger"
+	"github.com/pingcap/tidb/util/set"
 	"github.com/pingcap/tidb/util/tableutil"
+	pmodel "github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 )
 
@@ -352,3 +358,177 @@ func TestSortSpillDisk(t *testing.T) {
 	err = exe.Close()
 	require.NoError(t, err)
 }
+
+type fakeMetricCollector struct {
+	rows []infoschema.MetricRow
+}
+
+func (c *fakeMetricCollector) Collect(_ string, labels map[string]set.StringSet) ([]infoschema.MetricRow, error) {
+	rows := make([]infoschema.MetricRow, 0, len(c.rows))
+	for _, row := range c.rows {
+		if values, ok := labels["instance"]; ok && !values.Exist(row.Labels["instance"]) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func TestMetricRetrieverFromCollector(t *testing.T) {
+	const name = "test_internal_metric"
+	ctx := context.Background()
+	sctx := mock.NewContext()
+	now := time.Now()
+	tbl := &model.TableInfo{Name: model.NewCIStr(name)}
+	for _, col := range []string{"time", "instance", "value", infoschema.MetricQueryDurationColumn, infoschema.MetricErrorColumn} {
+		tbl.Columns = append(tbl.Columns, &model.ColumnInfo{Name: model.NewCIStr(col), Hidden: strings.HasPrefix(col, "_")})
+	}
+	newRetriever := func(labels map[string]set.StringSet) *MetricRetriever {
+		return &MetricRetriever{
+			table:  tbl,
+			tblDef: &infoschema.MetricTableDef{Labels: []string{"instance"}, Source: infoschema.MetricSourceInternal},
+			extractor: &plannercore.MetricTableExtractor{
+				StartTime:       now.Add(-time.Hour),
+				EndTime:         now,
+				LabelConditions: labels,
+			},
+		}
+	}
+
+	// The collector is resolved when the table is scanned, not when the retriever is built.
+	retriever := newRetriever(nil)
+	_, err := retriever.retrieve(ctx, sctx)
+	require.ErrorContains(t, err, "metric collector is not registered")
+
+	// The error row is returned instead if the session variable `tidb_metric_query_error_as_row` is on.
+	sctx.GetSessionVars().MetricSchemaErrorAsRow = true
+	retriever = newRetriever(nil)
+	rows, err := retriever.retrieve(ctx, sctx)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Len(t, rows[0], 5)
+	for _, d := range rows[0][:4] {
+		require.True(t, d.IsNull())
+	}
+	require.Contains(t, rows[0][4].GetString(), "metric collector is not registered")
+	warnings := sctx.GetSessionVars().StmtCtx.GetWarnings()
+	require.Len(t, warnings, 1)
+	require.ErrorContains(t, warnings[0].Err, "metric collector is not registered")
+	sctx.GetSessionVars().MetricSchemaErrorAsRow = false
+
+	retriever = newRetriever(map[string]set.StringSet{"instance": set.NewStringSet("127.0.0.1:10081")})
+	infoschema.RegisterMetricCollector(&fakeMetricCollector{rows: []infoschema.MetricRow{
+		{Time: now.Add(-time.Minute), Labels: map[string]string{"instance": "127.0.0.1:10080"}, Value: 1},
+		{Time: now.Add(-time.Minute), Labels: map[string]string{"instance": "127.0.0.1:10081"}, Value: 2},
+		{Time: now.Add(-2 * time.Hour), Labels: map[string]string{"instance": "127.0.0.1:10081"}, Value: 3},
+	}})
+	defer infoschema.RegisterMetricCollector(nil)
+	rows, err = retriever.retrieve(ctx, sctx)
+	require.NoError(t, err)
+	// The rows out of the time range and the label conditions are filtered.
+	require.Len(t, rows, 1)
+	// time, instance, value and the hidden `_query_duration_ms` and `_error`.
+	require.Len(t, rows[0], 5)
+	require.Equal(t, "127.0.0.1:10081", rows[0][1].GetString())
+	require.Equal(t, float64(2), rows[0][2].GetFloat64())
+	require.True(t, rows[0][4].IsNull())
+
+	// The metric table is only retrieved once.
+	rows, err = retriever.retrieve(ctx, sctx)
+	require.NoError(t, err)
+	require.Nil(t, rows)
+}
+
+func TestMetricRetrieverWithInvalidQuantile(t *testing.T) {
+	fpName := "github.com/pingcap/tidb/executor/mockMetricsPromData"
+	require.NoError(t, failpoint.Enable(fpName, "return"))
+	defer func() { require.NoError(t, failpoint.Disable(fpName)) }()
+
+	now := time.Now()
+	matrix := pmodel.Matrix{&pmodel.SampleStream{
+		Metric: pmodel.Metric{"instance": "127.0.0.1:10080"},
+		Values: []pmodel.SamplePair{{Timestamp: pmodel.TimeFromUnixNano(now.UnixNano()), Value: 0.1}},
+	}}
+	ctx := context.WithValue(context.Background(), MockMetricsPromDataKey{}, matrix)
+	ctx = failpoint.WithHook(ctx, func(ctx context.Context, fpname string) bool {
+		return fpname == fpName
+	})
+
+	// The quantile 99 is out of range, so the metric table doesn't have the quantile column.
+	def := &infoschema.MetricTableDef{
+		PromQL:   `histogram_quantile($QUANTILE, sum(rate(tidb_server_handle_query_duration_seconds_bucket{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (le,instance))`,
+		Labels:   []string{"instance"},
+		Quantile: 99,
+	}
+	require.False(t, def.HasQuantileColumn())
+	retriever := &MetricRetriever{
+		table:     &model.TableInfo{Name: model.NewCIStr("test_invalid_quantile")},
+		tblDef:    def,
+		extractor: &plannercore.MetricTableExtractor{StartTime: now.Add(-time.Hour), EndTime: now},
+	}
+	rows, err := retriever.retrieve(ctx, mock.NewContext())
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	// time, instance, value and the hidden columns, the value isn't shifted by the quantile.
+	require.Len(t, rows[0], 5)
+	require.Equal(t, "127.0.0.1:10080", rows[0][1].GetString())
+	require.Equal(t, 0.1, rows[0][2].GetFloat64())
+}
+
+func TestMetricRetrieverWithRangeValue(t *testing.T) {
+	fpName := "github.com/pingcap/tidb/executor/mockMetricsPromData"
+	require.NoError(t, failpoint.Enable(fpName, "return"))
+	defer func() { require.NoError(t, failpoint.Disable(fpName)) }()
+
+	const name = "test_qps_trend"
+	infoschema.MetricTableMap[name] = infoschema.MetricTableDef{
+		PromQL:      `sum(rate(tidb_server_query_total{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance)`,
+		RangePromQL: `avg_over_time(sum(rate(tidb_server_query_total{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance)[1h:])`,
+		Labels:      []string{"instance"},
+	}
+	defer delete(infoschema.MetricTableMap, name)
+
+	// mock prometheus data, the range value of the second instance is missing at the second time.
+	now := time.Now()
+	t1, t2 := pmodel.TimeFromUnixNano(now.Add(-time.Minute).UnixNano()), pmodel.TimeFromUnixNano(now.UnixNano())
+	metric1 := pmodel.Metric{"instance": "127.0.0.1:10080"}
+	metric2 := pmodel.Metric{"instance": "127.0.0.1:10081"}
+	matrix := pmodel.Matrix{
+		&pmodel.SampleStream{Metric: metric1, Values: []pmodel.SamplePair{{Timestamp: t1, Value: 10}, {Timestamp: t2, Value: 20}}},
+		&pmodel.SampleStream{Metric: metric2, Values: []pmodel.SamplePair{{Timestamp: t1, Value: 30}, {Timestamp: t2, Value: 40}}},
+	}
+	rangeMatrix := pmodel.Matrix{
+		&pmodel.SampleStream{Metric: metric1, Values: []pmodel.SamplePair{{Timestamp: t1, Value: 15}, {Timestamp: t2, Value: 16}}},
+		&pmodel.SampleStream{Metric: metric2, Values: []pmodel.SamplePair{{Timestamp: t1, Value: 35}}},
+	}
+	ctx := context.WithValue(context.Background(), MockMetricsPromDataKey{}, matrix)
+	ctx = context.WithValue(ctx, MockMetricsPromRangeDataKey{}, rangeMatrix)
+	ctx = failpoint.WithHook(ctx, func(ctx context.Context, fpname string) bool {
+		return fpname == fpName
+	})
+
+	retriever := &MetricRetriever{
+		table:     &model.TableInfo{Name: model.NewCIStr(name)},
+		extractor: &plannercore.MetricTableExtractor{StartTime: now.Add(-time.Hour), EndTime: now},
+	}
+	rows, err := retriever.retrieve(ctx, mock.NewContext())
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	expected := []struct {
+		instance   string
+		value      float64
+		rangeValue interface{}
+	}{
+		{"127.0.0.1:10080", 10, float64(15)},
+		{"127.0.0.1:10080", 20, float64(16)},
+		{"127.0.0.1:10081", 30, float64(35)},
+		{"127.0.0.1:10081", 40, nil},
+	}
+	for i, row := range rows {
+		// time, instance, value, range_value and the hidden columns.
+		require.Len(t, row, 6)
+		require.Equal(t, expected[i].instance, row[1].GetString())
+		require.Equal(t, expected[i].value, row[2].GetFloat64())
+		require.Equal(t, expected[i].rangeValue, row[3].GetValue())
+	}
+}
@@ -20,16 +20,20 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/fn"
 	"github.com/pingcap/sysutil"
 	"github.com/pingcap/tidb/executor"
+	"github.com/pingcap/tidb/infoschema"
+	"github.com/pingcap/tidb/session"
 	"github.com/pingcap/tidb/testkit"
 	"github.com/pingcap/tidb/util/pdapi"
 	pmodel "github.com/prometheus/common/model"
@@ -98,6 +102,160 @@ func TestMetricTableData(t *testing.T) {
 	}
 }
 
+func TestMetricTableDataWithQuantiles(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+
+	fpName := "github.com/pingcap/tidb/executor/mockMetricsPromData"
+	require.NoError(t, failpoint.Enable(fpName, "return"))
+	defer func() { require.NoError(t, failpoint.Disable(fpName)) }()
+
+	def := infoschema.MetricTableMap["tidb_query_duration"]
+	origin := def
+	def.Quantiles = []float64{0.5, 0.9, 0.99}
+	infoschema.MetricTableMap["tidb_query_duration"] = def
+	defer func() { infoschema.MetricTableMap["tidb_query_duration"] = origin }()
+
+	// mock prometheus data
+	metric := map[pmodel.LabelName]pmodel.LabelValue{
+		"instance": "127.0.0.1:10080",
+	}
+	tt, err := time.ParseInLocation("2006-01-02 15:04:05.999", "2019-12-23 20:11:35", time.Local)
+	require.NoError(t, err)
+	v1 := pmodel.SamplePair{
+		Timestamp: pmodel.Time(tt.UnixMilli()),
+		Value:     pmodel.SampleValue(0.1),
+	}
+	matrix := pmodel.Matrix{&pmodel.SampleStream{Metric: metric, Values: []pmodel.SamplePair{v1}}}
+
+	ctx := context.WithValue(context.Background(), executor.MockMetricsPromDataKey{}, matrix)
+	ctx = failpoint.WithHook(ctx, func(ctx context.Context, fpname string) bool {
+		return fpname == fpName
+	})
+
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use metrics_schema")
+
+	cases := []struct {
+		sql string
+		exp []string
+	}{
+		{
+			sql: "select time,instance,quantile,value from tidb_query_duration;",
+			exp: []string{
+				"2019-12-23 20:11:35.000000 127.0.0.1:10080 0.5 0.1",
+				"2019-12-23 20:11:35.000000 127.0.0.1:10080 0.9 0.1",
+				"2019-12-23 20:11:35.000000 127.0.0.1:10080 0.99 0.1",
+			},
+		},
+		{
+			sql: "select time,instance,quantile,value from tidb_query_duration where quantile=0.8",
+			exp: []string{
+				"2019-12-23 20:11:35.000000 127.0.0.1:10080 0.8 0.1",
+			},
+		},
+	}
+
+	for _, cas := range cases {
+		rs, err := tk.Session().Execute(ctx, cas.sql)
+		require.NoError(t, err)
+		result := tk.ResultSetToResultWithCtx(ctx, rs[0], fmt.Sprintf("sql: %s", cas.sql))
+		result.Check(testkit.Rows(cas.exp...))
+	}
+}
+
+func TestMetricTableDataErrorAsRow(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+
+	fpName := "github.com/pingcap/tidb/executor/mockMetricsPromData"
+	require.NoError(t, failpoint.Enable(fpName, "return"))
+	defer func() { require.NoError(t, failpoint.Disable(fpName)) }()
+
+	// mock the failed prometheus
+	ctx := context.WithValue(context.Background(), executor.MockMetricsPromDataKey{}, errors.New("prometheus is down"))
+	ctx = failpoint.WithHook(ctx, func(ctx context.Context, fpname string) bool {
+		return fpname == fpName
+	})
+
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use metrics_schema")
+	sql := "select time,instance,quantile,value,_error from tidb_query_duration"
+	rs, err := tk.ExecWithContext(ctx, sql)
+	require.NoError(t, err)
+	_, err = session.ResultSetToStringSlice(ctx, tk.Session(), rs)
+	require.ErrorContains(t, err, "query metric error: prometheus is down")
+
+	// The failed metric table returns a single error row, whose other columns are NULL, and a warning.
+	tk.MustExec("set @@tidb_metric_query_error_as_row = 1")
+	tk.MustQueryWithContext(ctx, sql).Check(testkit.Rows("<nil> <nil> <nil> <nil> query metric error: prometheus is down"))
+	tk.MustQuery("show warnings").Check(testkit.Rows("Warning 1105 query metric error: prometheus is down"))
+	tk.MustQueryWithContext(ctx, "select * from tidb_query_duration").Check(testkit.Rows("<nil> <nil> <nil> <nil> <nil> <nil> query metric error: prometheus is down"))
+	tk.MustQueryWithContext(ctx, "select _error, _query_duration_ms from tidb_query_duration").Check(testkit.Rows("query metric error: prometheus is down <nil>"))
+
+	// The error row is filtered out by the label condition, but the warning is kept.
+	tk.MustQueryWithContext(ctx, "select time,instance,value from tidb_query_duration where instance='127.0.0.1:10080'").Check(testkit.Rows())
+	tk.MustQuery("show warnings").Check(testkit.Rows("Warning 1105 query metric error: prometheus is down"))
+
+	// The rows of the quantiles queried before the error are dropped, only the error row is returned.
+	tt, err := time.ParseInLocation("2006-01-02 15:04:05.999", "2019-12-23 20:11:35", time.Local)
+	require.NoError(t, err)
+	matrix := pmodel.Matrix{&pmodel.SampleStream{
+		Metric: pmodel.Metric{"instance": "127.0.0.1:10080"},
+		Values: []pmodel.SamplePair{{Timestamp: pmodel.Time(tt.UnixMilli()), Value: 0.1}},
+	}}
+	ctx = context.WithValue(ctx, executor.MockMetricsPromDataKey{}, func(promQL string) (pmodel.Value, error) {
+		if strings.Contains(promQL, "histogram_quantile(0.9,") {
+			return nil, errors.New("prometheus is down")
+		}
+		return matrix, nil
+	})
+	tk.MustQueryWithContext(ctx, "select time,instance,quantile,value,_error from tidb_query_duration where quantile in (0.5, 0.9, 0.99)").Check(testkit.Rows(
+		"<nil> <nil> <nil> <nil> query metric error: prometheus is down",
+	))
+	tk.MustQuery("show warnings").Check(testkit.Rows("Warning 1105 query metric error: prometheus is down"))
+
+	// No warning if the metric table is queried successfully.
+	tk.MustQueryWithContext(ctx, "select time,instance,quantile,value,_error from tidb_query_duration where quantile = 0.5").Check(testkit.Rows(
+		"2019-12-23 20:11:35.000000 127.0.0.1:10080 0.5 0.1 <nil>",
+	))
+	tk.MustQuery("show warnings").Check(testkit.Rows())
+}
+
+func TestMetricTableQueryDuration(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+
+	fpName := "github.com/pingcap/tidb/executor/mockMetricsPromData"
+	require.NoError(t, failpoint.Enable(fpName, "return"))
+	defer func() { require.NoError(t, failpoint.Disable(fpName)) }()
+
+	tt, err := time.ParseInLocation("2006-01-02 15:04:05.999", "2019-12-23 20:11:35", time.Local)
+	require.NoError(t, err)
+	matrix := pmodel.Matrix{&pmodel.SampleStream{
+		Metric: pmodel.Metric{"instance": "127.0.0.1:10080"},
+		Values: []pmodel.SamplePair{{Timestamp: pmodel.Time(tt.UnixMilli()), Value: 0.1}},
+	}}
+	ctx := context.WithValue(context.Background(), executor.MockMetricsPromDataKey{}, matrix)
+	ctx = context.WithValue(ctx, executor.MockMetricsPromDelayKey{}, 10*time.Millisecond)
+	ctx = failpoint.WithHook(ctx, func(ctx context.Context, fpname string) bool {
+		return fpname == fpName
+	})
+
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use metrics_schema")
+	// The hidden columns are not shown by `desc`, but they are still returned by `*`.
+	require.Len(t, tk.MustQuery("desc tidb_query_duration").Rows(), 5)
+	rows := tk.MustQueryWithContext(ctx, "select * from tidb_query_duration").Rows()
+	require.Len(t, rows, 1)
+	// time, instance, sql_type, quantile, value, _query_duration_ms and _error.
+	require.Len(t, rows[0], 7)
+	require.Equal(t, "<nil>", rows[0][6])
+	rows = tk.MustQueryWithContext(ctx, "select value, _query_duration_ms from tidb_query_duration").Rows()
+	require.Len(t, rows, 1)
+	duration, err := strconv.ParseFloat(rows[0][1].(string), 64)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, duration, float64(10))
+	tk.MustQueryWithContext(ctx, "select count(*) from tidb_query_duration where _query_duration_ms >= 10").Check(testkit.Rows("1"))
+}
+
 func TestTiDBClusterConfig(t *testing.T) {
 	store := testkit.CreateMockStore(t)
 
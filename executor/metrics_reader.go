@@ -44,7 +44,8 @@ const promReadTimeout = time.Second * 10
 // MetricRetriever uses to read metric data.
 type MetricRetriever struct {
 	dummyCloser
-	table     *model.TableInfo
+	table *model.TableInfo
+	// tblDef is looked up by the table name when the metric data is retrieved if it's nil.
 	tblDef    *infoschema.MetricTableDef
 	extractor *plannercore.MetricTableExtractor
 	retrieved bool
@@ -63,38 +64,149 @@ func (e *MetricRetriever) retrieve(ctx context.Context, sctx sessionctx.Context)
 		}
 	})
 
-	tblDef, err := infoschema.GetMetricTableDef(e.table.Name.L)
-	if err != nil {
-		return nil, err
+	if e.tblDef == nil {
+		tblDef, err := infoschema.GetMetricTableDef(e.table.Name.L)
+		if err != nil {
+			return nil, err
+		}
+		e.tblDef = tblDef
+	}
+	tblDef := e.tblDef
+	if tblDef.IsInternal() {
+		rows, err := e.retrieveFromCollector()
+		if err != nil {
+			return e.handleQueryError(sctx, err)
+		}
+		return rows, nil
 	}
-	e.tblDef = tblDef
 	queryRange := e.getQueryRange(sctx)
 	totalRows := make([][]types.Datum, 0)
 	quantiles := e.extractor.Quantiles
 	if len(quantiles) == 0 {
-		quantiles = []float64{tblDef.Quantile}
+		quantiles = tblDef.DefaultQuantiles()
 	}
 	for _, quantile := range quantiles {
-		var queryValue pmodel.Value
-		queryValue, err = e.queryMetric(ctx, sctx, queryRange, quantile)
+		partRows, err := e.queryRows(ctx, sctx, queryRange, quantile)
 		if err != nil {
 			if err1, ok := err.(*promv1.Error); ok {
-				return nil, errors.Errorf("query metric error, msg: %v, detail: %v", err1.Msg, err1.Detail)
+				err = errors.Errorf("query metric error, msg: %v, detail: %v", err1.Msg, err1.Detail)
+			} else {
+				err = errors.Errorf("query metric error: %v", err.Error())
 			}
-			return nil, errors.Errorf("query metric error: %v", err.Error())
+			return e.handleQueryError(sctx, err)
 		}
-		partRows := e.genRows(queryValue, quantile)
 		totalRows = append(totalRows, partRows...)
 	}
 	return totalRows, nil
 }
 
+// retrieveFromCollector reads the metric data from the in-process collector instead of Prometheus.
+// The collector is resolved at scan time, so the cached infoschema doesn't hold the collector replaced later.
+func (e *MetricRetriever) retrieveFromCollector() ([][]types.Datum, error) {
+	collector := infoschema.GetMetricCollector()
+	if collector == nil {
+		return nil, errors.Errorf("metric collector is not registered for metric table: %v", e.table.Name.L)
+	}
+	start := time.Now()
+	metricRows, err := collector.Collect(e.table.Name.L, e.extractor.LabelConditions)
+	if err != nil {
+		return nil, errors.Errorf("collect metric error: %v", err.Error())
+	}
+	duration := genQueryDurationDatum(time.Since(start))
+	rows := make([][]types.Datum, 0, len(metricRows))
+	for _, row := range metricRows {
+		if row.Time.Before(e.extractor.StartTime) || row.Time.After(e.extractor.EndTime) {
+			continue
+		}
+		metric := make(pmodel.Metric, len(row.Labels))
+		for k, v := range row.Labels {
+			metric[pmodel.LabelName(k)] = pmodel.LabelValue(v)
+		}
+		pair := pmodel.SamplePair{Timestamp: pmodel.TimeFromUnixNano(row.Time.UnixNano()), Value: pmodel.SampleValue(row.Value)}
+		record := e.genRecord(metric, pair, e.tblDef.Quantile)
+		rows = append(rows, appendHiddenColumns(record, duration, types.NewDatum(nil)))
+	}
+	return rows, nil
+}
+
+// handleQueryError returns the error of querying the metric data. If the session variable
+// `tidb_metric_query_error_as_row` is on, a single error row is returned instead, whose hidden column `_error` is
+// the error and the other columns are NULL, so the statement doesn't fail. The error is also appended as a warning,
+// since the error row can be filtered out by the other conditions of the statement.
+func (e *MetricRetriever) handleQueryError(sctx sessionctx.Context, err error) ([][]types.Datum, error) {
+	if !sctx.GetSessionVars().MetricSchemaErrorAsRow {
+		return nil, err
+	}
+	sctx.GetSessionVars().StmtCtx.AppendWarning(err)
+	return [][]types.Datum{e.genErrorRow(err)}, nil
+}
+
+// genErrorRow generates the error row, the record order should keep same with genColumnInfos.
+func (e *MetricRetriever) genErrorRow(err error) []types.Datum {
+	record := make([]types.Datum, 0, len(e.table.Columns))
+	for _, col := range e.table.Columns {
+		if !col.Hidden {
+			record = append(record, types.NewDatum(nil))
+		}
+	}
+	return appendHiddenColumns(record, types.NewDatum(nil), types.NewStringDatum(err.Error()))
+}
+
+// appendHiddenColumns appends the hidden columns `_query_duration_ms` and `_error`.
+func appendHiddenColumns(record []types.Datum, queryDuration, queryErr types.Datum) []types.Datum {
+	return append(record, queryDuration, queryErr)
+}
+
 // MockMetricsPromDataKey is for test
 type MockMetricsPromDataKey struct{}
 
-func (e *MetricRetriever) queryMetric(ctx context.Context, sctx sessionctx.Context, queryRange promv1.Range, quantile float64) (result pmodel.Value, err error) {
+// MockMetricsPromRangeDataKey is for test, it is the mocked result of the range PromQL.
+type MockMetricsPromRangeDataKey struct{}
+
+// MockMetricsPromDelayKey is for test, it is the mocked latency of every Prometheus query.
+type MockMetricsPromDelayKey struct{}
+
+// queryRows queries the PromQL, and the range PromQL if the metric table has it, then generates the rows.
+func (e *MetricRetriever) queryRows(ctx context.Context, sctx sessionctx.Context, queryRange promv1.Range, quantile float64) ([][]types.Datum, error) {
+	promQL, err := e.tblDef.GenCheckedPromQL(sctx, e.extractor.LabelConditions, quantile)
+	if err != nil {
+		return nil, err
+	}
+	if e.extractor.TopK > 0 {
+		promQL = infoschema.GenTopKPromQL(promQL, e.extractor.TopK)
+	}
+	rangePromQL, err := e.tblDef.GenRangePromQL(sctx, e.extractor.LabelConditions, quantile)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	value, err := e.queryMetric(ctx, promQL, queryRange, MockMetricsPromDataKey{})
+	if err != nil {
+		return nil, err
+	}
+	if len(rangePromQL) == 0 {
+		return e.genRows(value, nil, quantile, time.Since(start)), nil
+	}
+	rangeValue, err := e.queryMetric(ctx, rangePromQL, queryRange, MockMetricsPromRangeDataKey{})
+	if err != nil {
+		return nil, err
+	}
+	return e.genRows(value, rangeValue, quantile, time.Since(start)), nil
+}
+
+func (e *MetricRetriever) queryMetric(ctx context.Context, promQL string, queryRange promv1.Range, mockKey interface{}) (result pmodel.Value, err error) {
 	failpoint.InjectContext(ctx, "mockMetricsPromData", func() {
-		failpoint.Return(ctx.Value(MockMetricsPromDataKey{}).(pmodel.Matrix), nil)
+		if delay, ok := ctx.Value(MockMetricsPromDelayKey{}).(time.Duration); ok {
+			time.Sleep(delay)
+		}
+		if err, ok := ctx.Value(mockKey).(error); ok {
+			failpoint.Return(nil, err)
+		}
+		if fn, ok := ctx.Value(mockKey).(func(promQL string) (pmodel.Value, error)); ok {
+			result, err := fn(promQL)
+			failpoint.Return(result, err)
+		}
+		failpoint.Return(ctx.Value(mockKey).(pmodel.Matrix), nil)
 	})
 
 	// Add retry to avoid network error.
@@ -119,7 +231,6 @@ func (e *MetricRetriever) queryMetric(ctx context.Context, sctx sessionctx.Conte
 	promQLAPI := promv1.NewAPI(promClient)
 	ctx, cancel := context.WithTimeout(ctx, promReadTimeout)
 	defer cancel()
-	promQL := e.tblDef.GenPromQL(sctx, e.extractor.LabelConditions, quantile)
 
 	// Add retry to avoid network error.
 	for i := 0; i < 5; i++ {
@@ -140,22 +251,44 @@ func (e *MetricRetriever) getQueryRange(sctx sessionctx.Context) promQLQueryRang
 	return promQLQueryRange{Start: startTime, End: endTime, Step: step}
 }
 
-func (e *MetricRetriever) genRows(value pmodel.Value, quantile float64) [][]types.Datum {
+// genRows generates the rows from the result of the PromQL, queryDuration is the time spent on querying it and the
+// range PromQL. If the metric table has the range PromQL, the sample of rangeValue with the same labels and time is
+// filled into the `range_value` column, which is NULL if there is none.
+func (e *MetricRetriever) genRows(value, rangeValue pmodel.Value, quantile float64, queryDuration time.Duration) [][]types.Datum {
 	var rows [][]types.Datum
-	if value.Type() == pmodel.ValMatrix {
-		matrix := value.(pmodel.Matrix)
-		for _, m := range matrix {
-			for _, v := range m.Values {
-				record := e.genRecord(m.Metric, v, quantile)
-				rows = append(rows, record)
+	if value.Type() != pmodel.ValMatrix {
+		return rows
+	}
+	var rangeSamples map[pmodel.Fingerprint]map[pmodel.Time]pmodel.SampleValue
+	if len(e.tblDef.RangePromQL) > 0 {
+		rangeSamples = make(map[pmodel.Fingerprint]map[pmodel.Time]pmodel.SampleValue)
+		if rangeValue != nil && rangeValue.Type() == pmodel.ValMatrix {
+			for _, m := range rangeValue.(pmodel.Matrix) {
+				samples := make(map[pmodel.Time]pmodel.SampleValue, len(m.Values))
+				for _, v := range m.Values {
+					samples[v.Timestamp] = v.Value
+				}
+				rangeSamples[m.Metric.Fingerprint()] = samples
 			}
 		}
 	}
+	duration := genQueryDurationDatum(queryDuration)
+	matrix := value.(pmodel.Matrix)
+	for _, m := range matrix {
+		for _, v := range m.Values {
+			record := e.genRecord(m.Metric, v, quantile)
+			if rangeSamples != nil {
+				rangeSample, ok := rangeSamples[m.Metric.Fingerprint()][v.Timestamp]
+				record = append(record, genValueDatum(rangeSample, ok))
+			}
+			rows = append(rows, appendHiddenColumns(record, duration, types.NewDatum(nil)))
+		}
+	}
 	return rows
 }
 
 func (e *MetricRetriever) genRecord(metric pmodel.Metric, pair pmodel.SamplePair, quantile float64) []types.Datum {
-	record := make([]types.Datum, 0, 2+len(e.tblDef.Labels)+1)
+	record := make([]types.Datum, 0, 2+len(e.tblDef.Labels)+2)
 	// Record order should keep same with genColumnInfos.
 	record = append(record, types.NewTimeDatum(types.NewTime(
 		types.FromGoTime(time.UnixMilli(int64(pair.Timestamp))),
@@ -172,17 +305,25 @@ func (e *MetricRetriever) genRecord(metric pmodel.Metric, pair pmodel.SamplePair
 		}
 		record = append(record, types.NewStringDatum(v))
 	}
-	if e.tblDef.Quantile > 0 {
+	if e.tblDef.HasQuantileColumn() {
 		record = append(record, types.NewFloat64Datum(quantile))
 	}
-	if math.IsNaN(float64(pair.Value)) {
-		record = append(record, types.NewDatum(nil))
-	} else {
-		record = append(record, types.NewFloat64Datum(float64(pair.Value)))
-	}
+	record = append(record, genValueDatum(pair.Value, true))
 	return record
 }
 
+// genQueryDurationDatum generates the datum of the hidden column `_query_duration_ms`.
+func genQueryDurationDatum(d time.Duration) types.Datum {
+	return types.NewFloat64Datum(float64(d) / float64(time.Millisecond))
+}
+
+func genValueDatum(value pmodel.SampleValue, exists bool) types.Datum {
+	if !exists || math.IsNaN(float64(value)) {
+		return types.NewDatum(nil)
+	}
+	return types.NewFloat64Datum(float64(value))
+}
+
 // MetricsSummaryRetriever uses to read metric data.
 type MetricsSummaryRetriever struct {
 	dummyCloser
@@ -220,7 +361,7 @@ func (e *MetricsSummaryRetriever) retrieve(ctx context.Context, sctx sessionctx.
 			continue
 		}
 		var sql string
-		if def.Quantile > 0 {
+		if def.HasQuantileColumn() {
 			var qs []string
 			if len(e.extractor.Quantiles) > 0 {
 				for _, q := range e.extractor.Quantiles {
@@ -243,7 +384,7 @@ func (e *MetricsSummaryRetriever) retrieve(ctx context.Context, sctx sessionctx.
 		}
 		for _, row := range rows {
 			var quantile interface{}
-			if def.Quantile > 0 {
+			if def.HasQuantileColumn() {
 				quantile = row.GetFloat64(row.Len() - 1)
 			}
 			totalRows = append(totalRows, types.MakeDatums(
@@ -298,7 +439,7 @@ func (e *MetricsSummaryByLabelRetriever) retrieve(ctx context.Context, sctx sess
 		}
 		cols := def.Labels
 		cond := condition
-		if def.Quantile > 0 {
+		if def.HasQuantileColumn() {
 			cols = append(cols, "quantile")
 			if len(e.extractor.Quantiles) > 0 {
 				qs := make([]string, len(e.extractor.Quantiles))
@@ -344,7 +485,7 @@ func (e *MetricsSummaryByLabelRetriever) retrieve(ctx context.Context, sctx sess
 				labels = append(labels, val)
 			}
 			var quantile interface{}
-			if def.Quantile > 0 {
+			if def.HasQuantileColumn() {
 				quantile = row.GetFloat64(row.Len() - 1) // quantile will be the last column
 			}
 			totalRows = append(totalRows, types.MakeDatums(
@@ -0,0 +1,76 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package infoschema
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/util/set"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMetricCollector struct {
+	rows []MetricRow
+}
+
+func (c *fakeMetricCollector) Collect(name string, labels map[string]set.StringSet) ([]MetricRow, error) {
+	rows := make([]MetricRow, 0, len(c.rows))
+	for _, row := range c.rows {
+		if values, ok := labels["instance"]; ok && !values.Exist(row.Labels["instance"]) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func TestInternalMetricTable(t *testing.T) {
+	const name = "test_internal_metric"
+	def := MetricTableDef{
+		Labels:  []string{"instance"},
+		Comment: "internal metric table for test",
+		Source:  MetricSourceInternal,
+	}
+	require.True(t, def.IsInternal())
+	require.NoError(t, def.Validate())
+	builtin, err := GetMetricTableDef("tidb_query_duration")
+	require.NoError(t, err)
+	require.False(t, builtin.IsInternal())
+
+	now := time.Now()
+	collector := &fakeMetricCollector{rows: []MetricRow{
+		{Time: now, Labels: map[string]string{"instance": "127.0.0.1:10080"}, Value: 1},
+		{Time: now, Labels: map[string]string{"instance": "127.0.0.1:10081"}, Value: 2},
+	}}
+	require.Nil(t, GetMetricCollector())
+	RegisterMetricCollector(collector)
+	defer RegisterMetricCollector(nil)
+	require.Equal(t, collector, GetMetricCollector())
+
+	rows, err := GetMetricCollector().Collect(name, map[string]set.StringSet{"instance": set.NewStringSet("127.0.0.1:10081")})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Equal(t, float64(2), rows[0].Value)
+
+	rows, err = GetMetricCollector().Collect(name, nil)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+
+	// The collector registered later replaces the old one.
+	other := &fakeMetricCollector{}
+	RegisterMetricCollector(other)
+	require.Equal(t, other, GetMetricCollector())
+}
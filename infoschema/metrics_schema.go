@@ -16,18 +16,27 @@ package infoschema
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/meta/autoid"
 	"github.com/pingcap/tidb/parser/model"
 	"github.com/pingcap/tidb/parser/mysql"
 	"github.com/pingcap/tidb/sessionctx"
+	"github.com/pingcap/tidb/sessionctx/variable"
 	"github.com/pingcap/tidb/table"
 	"github.com/pingcap/tidb/util"
+	"github.com/pingcap/tidb/util/logutil"
 	"github.com/pingcap/tidb/util/set"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -35,14 +44,26 @@ const (
 	promQLQuantileKey       = "$QUANTILE"
 	promQLLabelConditionKey = "$LABEL_CONDITIONS"
 	promQRangeDurationKey   = "$RANGE_DURATION"
+	promQLOffsetKey         = "$OFFSET"
 )
 
+// MetricQueryDurationColumn is the hidden column of every metric table, which is the duration in milliseconds of
+// querying the metric data in the scan. The hidden columns of the metric tables are not shown by `desc`,
+// `show columns` and `information_schema.columns`, but they are still returned by `select *`.
+const MetricQueryDurationColumn = "_query_duration_ms"
+
+// MetricErrorColumn is the hidden column of every metric table, which is the error of querying the metric data.
+// It is only set in the error row returned instead of the metric data when the session variable
+// `tidb_metric_query_error_as_row` is on, and the error is also appended as a warning of the statement.
+const MetricErrorColumn = "_error"
+
 func init() {
 	// Initialize the metric schema database and register the driver to `drivers`.
 	dbID := autoid.MetricSchemaDBID
 	tableID := dbID + 1
 	metricTables := make([]*model.TableInfo, 0, len(MetricTableMap))
-	for name, def := range MetricTableMap {
+	for _, name := range MetricTableNames() {
+		def := MetricTableMap[name]
 		cols := def.genColumnInfos()
 		tableInfo := buildTableMeta(name, cols)
 		tableInfo.ID = tableID
@@ -62,12 +83,80 @@ func init() {
 	RegisterVirtualTable(dbInfo, tableFromMeta)
 }
 
+// MetricSourceType is the source which the data of a metric table is read from.
+type MetricSourceType int
+
+const (
+	// MetricSourcePrometheus means the metric table is read from Prometheus by the generated PromQL.
+	MetricSourcePrometheus MetricSourceType = iota
+	// MetricSourceInternal means the metric table is read from the in-process MetricCollector.
+	MetricSourceInternal
+)
+
 // MetricTableDef is the metric table define.
 type MetricTableDef struct {
-	PromQL   string
-	Labels   []string
-	Quantile float64
-	Comment  string
+	PromQL string
+	// PromQLAlternatives are the alternative PromQLs which are `or`-ed with the PromQL, e.g. the PromQL of
+	// the old metric name after the metric is renamed. They get the same substitutions as the PromQL.
+	PromQLAlternatives []string
+	// RangePromQL is the PromQL of the range-aggregated value, e.g. the average of the PromQL in the last hour by
+	// `avg_over_time(...[1h:])`. The metric table has the `range_value` column next to the `value` column if it is
+	// not empty, so the current value and the trend are returned side by side. It gets the same substitutions as the PromQL.
+	RangePromQL string
+	Labels      []string
+	Quantile    float64
+	// Quantiles are the quantiles queried when the query doesn't specify the quantile, one row is returned
+	// for every quantile. Only the Quantile is queried if it is empty.
+	Quantiles []float64
+	// HashedLabels are the labels whose values are hashed by HashLabelValue in the label conditions, so the raw values,
+	// e.g. the instance IPs, are not sent to Prometheus. The operator must configure the relabeling of Prometheus to
+	// store the hashed values of these labels, otherwise the label conditions never match.
+	HashedLabels []string
+	// LabelDefaults are the label values used in the label conditions if the query has no condition on the labels.
+	LabelDefaults map[string]string
+	// RequiredLabels are the labels which must have conditions in the query or default values, otherwise the query
+	// fails instead of reading all the series of the labels, e.g. for the metric tables with too many series.
+	RequiredLabels []string
+	// NativeHistogram means the histograms of the metric are the Prometheus native histograms, whose buckets are
+	// stored in a single series of the metric instead of the `_bucket` series with the `le` label. The PromQL is
+	// written in the classic form, and the `_bucket` suffix and the `le` label of the aggregations are removed
+	// from it when the PromQL is generated, so `histogram_quantile` works on the native histograms.
+	NativeHistogram bool
+	Comment         string
+	Source          MetricSourceType
+}
+
+// MetricRow is a metric sample recorded by TiDB itself.
+type MetricRow struct {
+	Time   time.Time
+	Labels map[string]string
+	Value  float64
+}
+
+// MetricCollector collects the metrics recorded in-process by TiDB, it is used by the metric tables
+// whose source is MetricSourceInternal to avoid the round-trip to Prometheus.
+type MetricCollector interface {
+	Collect(name string, labels map[string]set.StringSet) ([]MetricRow, error)
+}
+
+var metricCollector struct {
+	sync.RWMutex
+	collector MetricCollector
+}
+
+// RegisterMetricCollector registers the collector used by the internal metric tables.
+func RegisterMetricCollector(collector MetricCollector) {
+	metricCollector.Lock()
+	defer metricCollector.Unlock()
+	metricCollector.collector = collector
+}
+
+// GetMetricCollector gets the registered collector, it returns nil if no collector is registered.
+// It should be called when the internal metric table is scanned, so the collector registered later is used.
+func GetMetricCollector() MetricCollector {
+	metricCollector.RLock()
+	defer metricCollector.RUnlock()
+	return metricCollector.collector
 }
 
 // IsMetricTable uses to checks whether the table is a metric table.
@@ -76,6 +165,32 @@ func IsMetricTable(lowerTableName string) bool {
 	return ok
 }
 
+// MetricTableNames returns the names of all the metric tables in alphabetical order.
+func MetricTableNames() []string {
+	names := make([]string, 0, len(MetricTableMap))
+	for name := range MetricTableMap {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// DumpMetricTables returns a copy of all the metric table defines.
+// The iteration order of a map is random, use MetricTableNames to iterate it in a deterministic order.
+func DumpMetricTables() map[string]MetricTableDef {
+	defs := make(map[string]MetricTableDef, len(MetricTableMap))
+	for name, def := range MetricTableMap {
+		def.PromQLAlternatives = slices.Clone(def.PromQLAlternatives)
+		def.Labels = slices.Clone(def.Labels)
+		def.Quantiles = slices.Clone(def.Quantiles)
+		def.HashedLabels = slices.Clone(def.HashedLabels)
+		def.LabelDefaults = maps.Clone(def.LabelDefaults)
+		def.RequiredLabels = slices.Clone(def.RequiredLabels)
+		defs[name] = def
+	}
+	return defs
+}
+
 // GetMetricTableDef gets the metric table define.
 func GetMetricTableDef(lowerTableName string) (*MetricTableDef, error) {
 	def, ok := MetricTableMap[lowerTableName]
@@ -85,6 +200,47 @@ func GetMetricTableDef(lowerTableName string) (*MetricTableDef, error) {
 	return &def, nil
 }
 
+// Validate checks whether the metric table define is valid.
+// The quantile should be in (0, 1], 0 means the metric table doesn't have the quantile column.
+func (def *MetricTableDef) Validate() error {
+	if def.Quantile < 0 || def.Quantile > 1 {
+		return errors.Errorf("the quantile of metric table should be in (0, 1], but got %v", def.Quantile)
+	}
+	if len(def.Quantiles) > 0 && def.Quantile == 0 {
+		return errors.New("the quantiles of metric table require the quantile column")
+	}
+	for _, quantile := range def.Quantiles {
+		if quantile <= 0 || quantile > 1 {
+			return errors.Errorf("the quantiles of metric table should be in (0, 1], but got %v", quantile)
+		}
+	}
+	if len(def.RangePromQL) > 0 && def.IsInternal() {
+		return errors.New("the range PromQL is not supported by the internal metric table")
+	}
+	for _, label := range def.RequiredLabels {
+		if !slices.Contains(def.Labels, label) {
+			return errors.Errorf("the required label %s is not a label of metric table", label)
+		}
+	}
+	if def.NativeHistogram && def.Quantile == 0 {
+		return errors.New("the native histogram of metric table requires the quantile column")
+	}
+	return nil
+}
+
+// HasQuantileColumn checks whether the metric table has the quantile column, i.e. the quantile is in (0, 1].
+func (def *MetricTableDef) HasQuantileColumn() bool {
+	return def.Quantile > 0 && def.Quantile <= 1
+}
+
+// DefaultQuantiles returns the quantiles queried when the query doesn't specify the quantile.
+func (def *MetricTableDef) DefaultQuantiles() []float64 {
+	if len(def.Quantiles) > 0 {
+		return def.Quantiles
+	}
+	return []float64{def.Quantile}
+}
+
 func (def *MetricTableDef) genColumnInfos() []columnInfo {
 	cols := []columnInfo{
 		{name: "time", tp: mysql.TypeDatetime, size: 19, deflt: "CURRENT_TIMESTAMP"},
@@ -92,45 +248,334 @@ func (def *MetricTableDef) genColumnInfos() []columnInfo {
 	for _, label := range def.Labels {
 		cols = append(cols, columnInfo{name: label, tp: mysql.TypeVarchar, size: 512})
 	}
-	if def.Quantile > 0 {
+	// The invalid defines are caught by the test over all the metric tables, they're only logged here, and the
+	// quantile column only depends on the quantile, so the schema isn't changed by the other invalid parts.
+	if err := def.Validate(); err != nil {
+		logutil.BgLogger().Error("invalid metric table define", zap.Error(err))
+	}
+	if def.HasQuantileColumn() {
 		defaultValue := strconv.FormatFloat(def.Quantile, 'f', -1, 64)
 		cols = append(cols, columnInfo{name: "quantile", tp: mysql.TypeDouble, size: 22, deflt: defaultValue})
 	}
 	cols = append(cols, columnInfo{name: "value", tp: mysql.TypeDouble, size: 22})
+	if len(def.RangePromQL) > 0 {
+		cols = append(cols, columnInfo{name: "range_value", tp: mysql.TypeDouble, size: 22})
+	}
+	cols = append(cols, columnInfo{name: MetricQueryDurationColumn, tp: mysql.TypeDouble, size: 22, hidden: true,
+		comment: "The duration in milliseconds of querying the metric data"})
+	cols = append(cols, columnInfo{name: MetricErrorColumn, tp: mysql.TypeVarchar, size: 1024, hidden: true,
+		comment: "The error of querying the metric data"})
 	return cols
 }
 
+// IsInternal checks whether the metric table is read from the in-process MetricCollector.
+func (def *MetricTableDef) IsInternal() bool {
+	return def.Source == MetricSourceInternal
+}
+
 // GenPromQL generates the promQL.
 func (def *MetricTableDef) GenPromQL(sctx sessionctx.Context, labels map[string]set.StringSet, quantile float64) string {
-	promQL := def.PromQL
+	if len(def.PromQLAlternatives) == 0 {
+		return def.substitutePromQL(sctx, def.PromQL, labels, quantile)
+	}
+	promQLs := make([]string, 0, len(def.PromQLAlternatives)+1)
+	for _, promQL := range append([]string{def.PromQL}, def.PromQLAlternatives...) {
+		if len(promQL) == 0 {
+			continue
+		}
+		promQLs = append(promQLs, "("+def.substitutePromQL(sctx, promQL, labels, quantile)+")")
+	}
+	return strings.Join(promQLs, " or ")
+}
+
+// GenCheckedPromQL generates the promQL like GenPromQL, but returns an error if
+//   - a required label has no condition and no default value, since the PromQL would query all the series of it.
+//   - the promQL is longer than the session variable `tidb_metric_query_max_promql_len`, e.g. the label conditions
+//     with thousands of values generate a PromQL that Prometheus rejects. The promQL is not truncated since the
+//     truncated one is not valid.
+func (def *MetricTableDef) GenCheckedPromQL(sctx sessionctx.Context, labels map[string]set.StringSet, quantile float64) (string, error) {
+	if err := def.checkRequiredLabels(labels); err != nil {
+		return "", err
+	}
+	promQL := def.GenPromQL(sctx, labels, quantile)
+	if err := checkPromQLLength(sctx, promQL); err != nil {
+		return "", err
+	}
+	return promQL, nil
+}
+
+// GenRangePromQL generates the promQL of the range-aggregated value, it is checked like GenCheckedPromQL.
+// It returns an empty string if the metric table has no RangePromQL.
+func (def *MetricTableDef) GenRangePromQL(sctx sessionctx.Context, labels map[string]set.StringSet, quantile float64) (string, error) {
+	if len(def.RangePromQL) == 0 {
+		return "", nil
+	}
+	if err := def.checkRequiredLabels(labels); err != nil {
+		return "", err
+	}
+	promQL := def.substitutePromQL(sctx, def.RangePromQL, labels, quantile)
+	if err := checkPromQLLength(sctx, promQL); err != nil {
+		return "", err
+	}
+	return promQL, nil
+}
+
+// GenTopKPromQL wraps the promQL by `topk` to select the `k` series with the largest values at every timestamp.
+func GenTopKPromQL(promQL string, k uint64) string {
+	return fmt.Sprintf("topk(%d, %s)", k, promQL)
+}
+
+func (def *MetricTableDef) checkRequiredLabels(labels map[string]set.StringSet) error {
+	for _, label := range def.RequiredLabels {
+		if len(labels[label]) > 0 {
+			continue
+		}
+		if _, ok := def.LabelDefaults[label]; ok {
+			continue
+		}
+		return errors.Errorf("the label %s of metric table is required, please specify its values in the conditions", label)
+	}
+	return nil
+}
+
+func checkPromQLLength(sctx sessionctx.Context, promQL string) error {
+	maxLen := sctx.GetSessionVars().MetricSchemaMaxPromQLLen
+	if maxLen > 0 && len(promQL) > maxLen {
+		return errors.Errorf("the length of the PromQL of metric table is %d, exceeds the limit %d of %s",
+			len(promQL), maxLen, variable.TiDBMetricSchemaMaxPromQLLen)
+	}
+	return nil
+}
+
+func (def *MetricTableDef) substitutePromQL(sctx sessionctx.Context, promQL string, labels map[string]set.StringSet, quantile float64) string {
+	if def.NativeHistogram {
+		promQL = toNativeHistogramPromQL(promQL)
+	}
+	offset := genOffset(sctx)
+	if len(offset) > 0 && !strings.Contains(promQL, promQLOffsetKey) {
+		promQL = placeOffsetKey(promQL)
+	}
 	promQL = strings.ReplaceAll(promQL, promQLQuantileKey, strconv.FormatFloat(quantile, 'f', -1, 64))
-	promQL = strings.ReplaceAll(promQL, promQLLabelConditionKey, def.genLabelCondition(labels))
+	promQL = strings.ReplaceAll(promQL, promQLLabelConditionKey, def.genLabelCondition(sctx, labels))
 	promQL = strings.ReplaceAll(promQL, promQRangeDurationKey, strconv.FormatInt(sctx.GetSessionVars().MetricSchemaRangeDuration, 10)+"s")
+	promQL = strings.ReplaceAll(promQL, promQLOffsetKey, offset)
 	return promQL
 }
 
-func (def *MetricTableDef) genLabelCondition(labels map[string]set.StringSet) string {
+var (
+	bucketSelectorRegexp = regexp.MustCompile(`(\w+)_bucket\{`)
+	groupingRegexp       = regexp.MustCompile(`\b(by|without)\s*\(([^)]*)\)`)
+)
+
+// toNativeHistogramPromQL converts the classic histogram PromQL to the one of the native histograms by removing
+// the `_bucket` suffix of the selectors and the `le` label of the aggregations.
+func toNativeHistogramPromQL(promQL string) string {
+	promQL = bucketSelectorRegexp.ReplaceAllString(promQL, "${1}{")
+	return groupingRegexp.ReplaceAllStringFunc(promQL, func(grouping string) string {
+		match := groupingRegexp.FindStringSubmatch(grouping)
+		labels := strings.Split(match[2], ",")
+		kept := labels[:0]
+		for _, label := range labels {
+			if strings.TrimSpace(label) != "le" {
+				kept = append(kept, label)
+			}
+		}
+		return match[1] + " (" + strings.Join(kept, ",") + ")"
+	})
+}
+
+// genOffset generates the `offset` modifier placed after the selectors, it is empty if there is no offset.
+func genOffset(sctx sessionctx.Context) string {
+	offset := sctx.GetSessionVars().MetricSchemaOffset
+	if offset <= 0 {
+		return ""
+	}
+	if offset%time.Second == 0 {
+		return " offset " + strconv.FormatInt(int64(offset/time.Second), 10) + "s"
+	}
+	return " offset " + strconv.FormatInt(offset.Milliseconds(), 10) + "ms"
+}
+
+var (
+	promQLKeywords = map[string]struct{}{
+		"by": {}, "without": {}, "on": {}, "ignoring": {}, "group_left": {}, "group_right": {},
+		"bool": {}, "offset": {}, "and": {}, "or": {}, "unless": {}, "inf": {}, "nan": {},
+	}
+	promQLGroupingKeywords = map[string]struct{}{
+		"by": {}, "without": {}, "on": {}, "ignoring": {}, "group_left": {}, "group_right": {},
+	}
+)
+
+func isPromQLIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isPromQLIdentChar(c byte) bool {
+	return isPromQLIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// skipPromQLString returns the index after the quoted string starting at i.
+func skipPromQLString(promQL string, i int) int {
+	quote := promQL[i]
+	for i++; i < len(promQL) && promQL[i] != quote; i++ {
+		if promQL[i] == '\\' && quote != '`' {
+			i++
+		}
+	}
+	if i < len(promQL) {
+		i++
+	}
+	return i
+}
+
+// placeOffsetKey places the `$OFFSET` placeholder after every selector of the PromQL, so the offset is applied to
+// the PromQL without the placeholder, e.g. the built-in metric tables. A selector is the metric name, with the
+// optional label matchers and range, which is not a keyword, a function or a label of a grouping like `by (instance)`.
+func placeOffsetKey(promQL string) string {
+	var buf strings.Builder
+	// groupings records whether every open parenthesis is the label list of a grouping keyword.
+	var groupings []bool
+	grouping := false
+	for i := 0; i < len(promQL); {
+		c := promQL[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end := skipPromQLString(promQL, i)
+			buf.WriteString(promQL[i:end])
+			i = end
+		case c == '$':
+			end := i + 1
+			for end < len(promQL) && isPromQLIdentChar(promQL[end]) {
+				end++
+			}
+			buf.WriteString(promQL[i:end])
+			i = end
+		case c == '(':
+			groupings = append(groupings, grouping)
+			grouping = false
+			buf.WriteByte(c)
+			i++
+		case c == ')':
+			if len(groupings) > 0 {
+				groupings = groupings[:len(groupings)-1]
+			}
+			buf.WriteByte(c)
+			i++
+		case c == '[':
+			// The range of a subquery, the range of a selector is consumed with the selector.
+			end := len(promQL)
+			if idx := strings.IndexByte(promQL[i:], ']'); idx >= 0 {
+				end = i + idx + 1
+			}
+			buf.WriteString(promQL[i:end])
+			i = end
+		case c == '{' || (isPromQLIdentStart(c) && (i == 0 || !(isPromQLIdentChar(promQL[i-1]) || promQL[i-1] == '.'))):
+			end := i
+			for end < len(promQL) && isPromQLIdentChar(promQL[end]) {
+				end++
+			}
+			name := strings.ToLower(promQL[i:end])
+			next := end
+			for next < len(promQL) && promQL[next] == ' ' {
+				next++
+			}
+			_, isKeyword := promQLKeywords[name]
+			isFunction := next < len(promQL) && promQL[next] == '('
+			if isKeyword || isFunction || (len(groupings) > 0 && groupings[len(groupings)-1]) {
+				_, grouping = promQLGroupingKeywords[name]
+				buf.WriteString(promQL[i:end])
+				i = end
+				continue
+			}
+			if end < len(promQL) && promQL[end] == '{' {
+				for end++; end < len(promQL) && promQL[end] != '}'; {
+					if c := promQL[end]; c == '"' || c == '\'' || c == '`' {
+						end = skipPromQLString(promQL, end)
+					} else {
+						end++
+					}
+				}
+				if end < len(promQL) {
+					end++
+				}
+			}
+			if end < len(promQL) && promQL[end] == '[' {
+				if idx := strings.IndexByte(promQL[end:], ']'); idx >= 0 {
+					end += idx + 1
+				}
+			}
+			buf.WriteString(promQL[i:end])
+			buf.WriteString(promQLOffsetKey)
+			i = end
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	return buf.String()
+}
+
+func (def *MetricTableDef) genLabelCondition(sctx sessionctx.Context, labels map[string]set.StringSet) string {
 	var buf bytes.Buffer
 	index := 0
+	// The extra label conditions are added to all the metric queries, e.g. to force the tenant label.
+	for _, m := range sctx.GetSessionVars().MetricSchemaExtraLabelConditions {
+		writeLabelMatcher(&buf, m.Label, m.Op, m.Value, index)
+		index++
+	}
+	// The conditions are generated in the declared order of the labels, the ones from the query come first and
+	// the default ones come last, so the generated PromQL is stable.
+	var defaults []string
 	for _, label := range def.Labels {
 		values := labels[label]
 		if len(values) == 0 {
+			if _, ok := def.LabelDefaults[label]; ok {
+				defaults = append(defaults, label)
+			}
 			continue
 		}
-		if index > 0 {
-			buf.WriteByte(',')
-		}
-		switch len(values) {
-		case 1:
-			buf.WriteString(fmt.Sprintf("%s=\"%s\"", label, GenLabelConditionValues(values)))
-		default:
-			buf.WriteString(fmt.Sprintf("%s=~\"%s\"", label, GenLabelConditionValues(values)))
-		}
+		def.writeLabelCondition(&buf, label, values, index)
+		index++
+	}
+	for _, label := range defaults {
+		def.writeLabelCondition(&buf, label, set.NewStringSet(def.LabelDefaults[label]), index)
 		index++
 	}
 	return buf.String()
 }
 
+func (def *MetricTableDef) writeLabelCondition(buf *bytes.Buffer, label string, values set.StringSet, index int) {
+	if slices.Contains(def.HashedLabels, label) {
+		hashed := make(set.StringSet, len(values))
+		for value := range values {
+			hashed.Insert(HashLabelValue(value))
+		}
+		values = hashed
+	}
+	switch len(values) {
+	case 1:
+		writeLabelMatcher(buf, label, "=", GenLabelConditionValues(values), index)
+	default:
+		writeLabelMatcher(buf, label, "=~", GenLabelConditionValues(values), index)
+	}
+}
+
+// writeLabelMatcher writes the label matcher with the quoted value, the index-th matcher is preceded by a comma.
+func writeLabelMatcher(buf *bytes.Buffer, label, op, value string, index int) {
+	if index > 0 {
+		buf.WriteByte(',')
+	}
+	buf.WriteString(label)
+	buf.WriteString(op)
+	buf.WriteString(strconv.Quote(value))
+}
+
+// HashLabelValue returns the hex encoded SHA-256 of the label value, which is used in the conditions of the HashedLabels.
+func HashLabelValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
 // GenLabelConditionValues generates the label condition values.
 func GenLabelConditionValues(values set.StringSet) string {
 	vs := make([]string, 0, len(values))
@@ -0,0 +1,65 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package infoschema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricTableDefQuantile(t *testing.T) {
+	hasQuantileCol := func(cols []columnInfo) (string, bool) {
+		for _, col := range cols {
+			if col.name == "quantile" {
+				return col.deflt.(string), true
+			}
+		}
+		return "", false
+	}
+
+	def := MetricTableDef{Quantile: 0.99}
+	require.NoError(t, def.Validate())
+	deflt, ok := hasQuantileCol(def.genColumnInfos())
+	require.True(t, ok)
+	require.Equal(t, "0.99", deflt)
+
+	def = MetricTableDef{Quantile: 99}
+	require.Error(t, def.Validate())
+	_, ok = hasQuantileCol(def.genColumnInfos())
+	require.False(t, ok)
+
+	def = MetricTableDef{Quantile: 0}
+	require.NoError(t, def.Validate())
+	_, ok = hasQuantileCol(def.genColumnInfos())
+	require.False(t, ok)
+
+	// The quantile column doesn't depend on the other parts of the define.
+	def = MetricTableDef{Quantile: 0.9, Labels: []string{"instance"}, RequiredLabels: []string{"instnace"}}
+	require.Error(t, def.Validate())
+	deflt, ok = hasQuantileCol(def.genColumnInfos())
+	require.True(t, ok)
+	require.Equal(t, "0.9", deflt)
+
+	def = MetricTableDef{Quantile: 0.9, Quantiles: []float64{0.5, 0.9, 0.99}}
+	require.NoError(t, def.Validate())
+	require.Equal(t, []float64{0.5, 0.9, 0.99}, def.DefaultQuantiles())
+	def = MetricTableDef{Quantile: 0.9}
+	require.Equal(t, []float64{0.9}, def.DefaultQuantiles())
+	def = MetricTableDef{Quantile: 0.9, Quantiles: []float64{0.5, 2}}
+	require.Error(t, def.Validate())
+	def = MetricTableDef{Quantiles: []float64{0.5}}
+	require.Error(t, def.Validate())
+}
@@ -15,14 +15,19 @@
 package infoschema_test
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/pingcap/tidb/infoschema"
+	"github.com/pingcap/tidb/sessionctx/variable"
+	"github.com/pingcap/tidb/util/mock"
 	"github.com/pingcap/tidb/util/set"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
 )
 
 func mockGenPromQL(promQL string) string {
@@ -34,6 +39,7 @@ func mockGenPromQL(promQL string) string {
 
 func TestMetricSchemaDef(t *testing.T) {
 	for name, def := range infoschema.MetricTableMap {
+		require.NoErrorf(t, def.Validate(), "metric table %v is invalid", name)
 		if strings.Contains(def.PromQL, "$QUANTILE") || strings.Contains(def.PromQL, "histogram_quantile") {
 			require.Greaterf(t, def.Quantile, float64(0), "the quantile of metric table %v should > 0", name)
 		} else {
@@ -65,5 +71,241 @@ func TestMetricSchemaDef(t *testing.T) {
 
 		_, err := promql.ParseExpr(mockGenPromQL(def.PromQL))
 		require.NoError(t, err, "fail to parser PromQL %s", def.PromQL)
+		if len(def.RangePromQL) > 0 {
+			_, err = promql.ParseExpr(mockGenPromQL(def.RangePromQL))
+			require.NoError(t, err, "fail to parser PromQL %s", def.RangePromQL)
+		}
+	}
+}
+
+func TestMetricTableNames(t *testing.T) {
+	names := infoschema.MetricTableNames()
+	require.Len(t, names, len(infoschema.MetricTableMap))
+	require.True(t, slices.IsSorted(names))
+	for i := 0; i < 10; i++ {
+		require.Equal(t, names, infoschema.MetricTableNames())
+	}
+
+	defs := infoschema.DumpMetricTables()
+	require.Len(t, defs, len(names))
+	for _, name := range names {
+		require.Equal(t, infoschema.MetricTableMap[name], defs[name])
+	}
+	// Modifying the dumped defines doesn't affect the metric tables.
+	def := defs["tidb_query_duration"]
+	def.Labels[0] = "modified"
+	require.NotEqual(t, "modified", infoschema.MetricTableMap["tidb_query_duration"].Labels[0])
+}
+
+func TestMetricSchemaExtraLabelConditions(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	matchers, err := variable.ParseMetricLabelMatchers(`tenant=x`)
+	require.NoError(t, err)
+	sctx.GetSessionVars().MetricSchemaExtraLabelConditions = matchers
+	labels := map[string]set.StringSet{"instance": set.NewStringSet("127.0.0.1:10080")}
+	for name, def := range infoschema.MetricTableMap {
+		if !strings.Contains(def.PromQL, "$LABEL_CONDITIONS") {
+			continue
+		}
+		promQL := def.GenPromQL(sctx, nil, 0.99)
+		require.Containsf(t, promQL, `{tenant="x"}`, "metric table %v doesn't contain the extra label conditions", name)
+		_, err := promql.ParseExpr(promQL)
+		require.NoError(t, err, "fail to parser PromQL %s", promQL)
+
+		if slices.Contains(def.Labels, "instance") {
+			promQL = def.GenPromQL(sctx, labels, 0.99)
+			require.Containsf(t, promQL, `{tenant="x",instance="127.0.0.1:10080"`, "metric table %v doesn't contain the extra label conditions", name)
+			_, err = promql.ParseExpr(promQL)
+			require.NoError(t, err, "fail to parser PromQL %s", promQL)
+		}
 	}
 }
+
+func TestMetricSchemaPromQLAlternatives(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableDef{
+		PromQL:             `sum(rate(tidb_new_metric_total{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance)`,
+		PromQLAlternatives: []string{`sum(rate(tidb_old_metric_total{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance)`},
+		Labels:             []string{"instance"},
+	}
+	labels := map[string]set.StringSet{"instance": set.NewStringSet("127.0.0.1:10080")}
+	promQL := def.GenPromQL(sctx, labels, 0)
+	require.Equal(t, `(sum(rate(tidb_new_metric_total{instance="127.0.0.1:10080"}[60s])) by (instance)) or `+
+		`(sum(rate(tidb_old_metric_total{instance="127.0.0.1:10080"}[60s])) by (instance))`, promQL)
+	_, err := promql.ParseExpr(promQL)
+	require.NoError(t, err, "fail to parser PromQL %s", promQL)
+}
+
+func TestMetricSchemaOffset(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableDef{
+		PromQL: `sum(rate(tidb_server_handle_query_duration_seconds_count{$LABEL_CONDITIONS}[$RANGE_DURATION]$OFFSET)) by (instance)`,
+		Labels: []string{"instance"},
+	}
+	promQL := def.GenPromQL(sctx, nil, 0)
+	require.Equal(t, `sum(rate(tidb_server_handle_query_duration_seconds_count{}[60s])) by (instance)`, promQL)
+
+	sctx.GetSessionVars().MetricSchemaOffset = time.Hour
+	promQL = def.GenPromQL(sctx, nil, 0)
+	require.Equal(t, `sum(rate(tidb_server_handle_query_duration_seconds_count{}[60s] offset 3600s)) by (instance)`, promQL)
+	_, err := promql.ParseExpr(promQL)
+	require.NoError(t, err, "fail to parser PromQL %s", promQL)
+
+	sctx.GetSessionVars().MetricSchemaOffset = 1500 * time.Millisecond
+	promQL = def.GenPromQL(sctx, nil, 0)
+	require.Contains(t, promQL, "[60s] offset 1500ms)")
+	_, err = promql.ParseExpr(promQL)
+	require.NoError(t, err, "fail to parser PromQL %s", promQL)
+
+	// The offset is placed after every selector of the PromQL without $OFFSET, e.g. the built-in metric tables.
+	def = infoschema.MetricTableDef{
+		PromQL: `sum(rate(tidb_server_query_total{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance) / on(instance) group_left sum(tidb_server_connections{type="a}b"})`,
+		Labels: []string{"instance"},
+	}
+	sctx.GetSessionVars().MetricSchemaOffset = time.Hour
+	promQL = def.GenPromQL(sctx, nil, 0)
+	require.Equal(t, `sum(rate(tidb_server_query_total{}[60s] offset 3600s)) by (instance) / on(instance) group_left sum(tidb_server_connections{type="a}b"} offset 3600s)`, promQL)
+	builtin, err := infoschema.GetMetricTableDef("tidb_query_duration")
+	require.NoError(t, err)
+	promQL = builtin.GenPromQL(sctx, nil, 0.9)
+	require.Equal(t, "histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s] offset 3600s)) by (le,sql_type,instance))", promQL)
+	for name, def := range infoschema.MetricTableMap {
+		promQL = def.GenPromQL(sctx, nil, 0.5)
+		require.Containsf(t, promQL, " offset 3600s", "metric table %v doesn't apply the offset", name)
+		_, err = promql.ParseExpr(promQL)
+		require.NoError(t, err, "fail to parser PromQL %s", promQL)
+	}
+	sctx.GetSessionVars().MetricSchemaOffset = 0
+	promQL = builtin.GenPromQL(sctx, nil, 0.9)
+	require.Equal(t, "histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))", promQL)
+}
+
+func TestMetricSchemaHashedLabels(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableDef{
+		PromQL:       `sum(rate(tidb_server_handle_query_duration_seconds_count{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance,type)`,
+		Labels:       []string{"instance", "type"},
+		HashedLabels: []string{"instance"},
+	}
+	hashed := infoschema.HashLabelValue("127.0.0.1:10080")
+	require.Len(t, hashed, 64)
+	require.NotEqual(t, hashed, infoschema.HashLabelValue("127.0.0.1:10081"))
+
+	labels := map[string]set.StringSet{
+		"instance": set.NewStringSet("127.0.0.1:10080"),
+		"type":     set.NewStringSet("Query"),
+	}
+	promQL := def.GenPromQL(sctx, labels, 0)
+	require.NotContains(t, promQL, "127.0.0.1")
+	require.Contains(t, promQL, `{instance="`+hashed+`",type="Query"}`)
+	_, err := promql.ParseExpr(promQL)
+	require.NoError(t, err, "fail to parser PromQL %s", promQL)
+}
+
+func TestMetricSchemaLabelConditionOrder(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableDef{
+		PromQL:        `sum(rate(tidb_server_handle_query_duration_seconds_count{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance,type,sql_type)`,
+		Labels:        []string{"instance", "type", "sql_type"},
+		LabelDefaults: map[string]string{"instance": "127.0.0.1:10080", "sql_type": "internal"},
+	}
+	labels := map[string]set.StringSet{
+		"sql_type": set.NewStringSet("Select", "Insert", "Delete"),
+		"type":     set.NewStringSet("Query"),
+	}
+	expected := `sum(rate(tidb_server_handle_query_duration_seconds_count{type="Query",sql_type=~"Delete|Insert|Select",instance="127.0.0.1:10080"}[60s])) by (instance,type,sql_type)`
+	for i := 0; i < 10; i++ {
+		require.Equal(t, expected, def.GenPromQL(sctx, labels, 0))
+	}
+
+	// The explicit conditions override the defaults.
+	labels["instance"] = set.NewStringSet("127.0.0.1:10081")
+	promQL := def.GenPromQL(sctx, labels, 0)
+	require.Contains(t, promQL, `{instance="127.0.0.1:10081",type="Query",sql_type=~"Delete|Insert|Select"}`)
+	_, err := promql.ParseExpr(promQL)
+	require.NoError(t, err, "fail to parser PromQL %s", promQL)
+}
+
+func TestMetricSchemaMaxPromQLLen(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableDef{
+		PromQL: `sum(rate(tidb_server_handle_query_duration_seconds_count{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance)`,
+		Labels: []string{"instance"},
+	}
+	instances := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		instances = append(instances, fmt.Sprintf("127.0.0.1:%d", 10000+i))
+	}
+	labels := map[string]set.StringSet{"instance": set.NewStringSet(instances...)}
+	expected := def.GenPromQL(sctx, labels, 0)
+
+	// The length is not limited by default.
+	promQL, err := def.GenCheckedPromQL(sctx, labels, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, promQL)
+
+	sctx.GetSessionVars().MetricSchemaMaxPromQLLen = len(expected)
+	promQL, err = def.GenCheckedPromQL(sctx, labels, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, promQL)
+
+	sctx.GetSessionVars().MetricSchemaMaxPromQLLen = 1024
+	_, err = def.GenCheckedPromQL(sctx, labels, 0)
+	require.EqualError(t, err, fmt.Sprintf("the length of the PromQL of metric table is %d, exceeds the limit 1024 of tidb_metric_query_max_promql_len", len(expected)))
+	promQL, err = def.GenCheckedPromQL(sctx, map[string]set.StringSet{"instance": set.NewStringSet(instances[0])}, 0)
+	require.NoError(t, err)
+	require.Contains(t, promQL, `{instance="127.0.0.1:10000"}`)
+}
+
+func TestMetricSchemaRequiredLabels(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableDef{
+		PromQL:         `sum(rate(tidb_server_handle_query_duration_seconds_count{$LABEL_CONDITIONS}[$RANGE_DURATION])) by (instance,type)`,
+		Labels:         []string{"instance", "type"},
+		RequiredLabels: []string{"instance"},
+	}
+	require.NoError(t, def.Validate())
+
+	// The optional label is skipped, but the required label can't be omitted.
+	_, err := def.GenCheckedPromQL(sctx, map[string]set.StringSet{"type": set.NewStringSet("Query")}, 0)
+	require.EqualError(t, err, "the label instance of metric table is required, please specify its values in the conditions")
+	promQL, err := def.GenCheckedPromQL(sctx, map[string]set.StringSet{"instance": set.NewStringSet("127.0.0.1:10080")}, 0)
+	require.NoError(t, err)
+	require.Contains(t, promQL, `{instance="127.0.0.1:10080"}`)
+
+	// The default value satisfies the required label.
+	def.LabelDefaults = map[string]string{"instance": "127.0.0.1:10081"}
+	promQL, err = def.GenCheckedPromQL(sctx, nil, 0)
+	require.NoError(t, err)
+	require.Contains(t, promQL, `{instance="127.0.0.1:10081"}`)
+
+	def.RequiredLabels = []string{"sql_type"}
+	require.EqualError(t, def.Validate(), "the required label sql_type is not a label of metric table")
+}
+
+func TestMetricSchemaNativeHistogram(t *testing.T) {
+	sctx := mock.NewContext()
+	sctx.GetSessionVars().MetricSchemaRangeDuration = 60
+	def := infoschema.MetricTableMap["tidb_query_duration"]
+	labels := map[string]set.StringSet{"instance": set.NewStringSet("127.0.0.1:10080")}
+	classic := def.GenPromQL(sctx, labels, 0.99)
+	require.Equal(t, `histogram_quantile(0.99, sum(rate(tidb_server_handle_query_duration_seconds_bucket{instance="127.0.0.1:10080"}[60s])) by (le,sql_type,instance))`, classic)
+
+	def.NativeHistogram = true
+	require.NoError(t, def.Validate())
+	native := def.GenPromQL(sctx, labels, 0.99)
+	require.Equal(t, `histogram_quantile(0.99, sum(rate(tidb_server_handle_query_duration_seconds{instance="127.0.0.1:10080"}[60s])) by (sql_type,instance))`, native)
+	require.NotEqual(t, classic, native)
+	_, err := promql.ParseExpr(native)
+	require.NoError(t, err)
+
+	def.Quantile = 0
+	require.EqualError(t, def.Validate(), "the native histogram of metric table requires the quantile column")
+}
@@ -333,6 +333,8 @@ type columnInfo struct {
 	comment string
 	// enumElems represent all possible literal string values of an enum column
 	enumElems []string
+	// hidden columns are not shown by `DESC` and `information_schema.columns`, but they are still returned by `SELECT *`
+	hidden bool
 }
 
 func buildColumnInfo(col columnInfo) *model.ColumnInfo {
@@ -356,6 +358,7 @@ func buildColumnInfo(col columnInfo) *model.ColumnInfo {
 		State:        model.StatePublic,
 		DefaultValue: col.deflt,
 		Comment:      col.comment,
+		Hidden:       col.hidden,
 	}
 }
 
@@ -2168,12 +2171,22 @@ func (it *infoschemaTable) Cols() []*table.Column {
 
 // VisibleCols implements table.Table VisibleCols interface.
 func (it *infoschemaTable) VisibleCols() []*table.Column {
-	return it.cols
+	return it.getCols(false)
 }
 
 // HiddenCols implements table.Table HiddenCols interface.
 func (it *infoschemaTable) HiddenCols() []*table.Column {
-	return nil
+	return it.getCols(true)
+}
+
+func (it *infoschemaTable) getCols(hidden bool) []*table.Column {
+	columns := make([]*table.Column, 0, len(it.cols))
+	for _, col := range it.cols {
+		if col.Hidden == hidden {
+			columns = append(columns, col)
+		}
+	}
+	return columns
 }
 
 // WritableCols implements table.Table WritableCols interface.
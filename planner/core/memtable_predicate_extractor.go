@@ -890,6 +890,9 @@ type MetricTableExtractor struct {
 	// LabelConditions represents the label conditions of metric data.
 	LabelConditions map[string]set.StringSet
 	Quantiles       []float64
+	// TopK is the number of the series with the largest values selected by Prometheus at every timestamp, it's pushed
+	// down from `ORDER BY value DESC LIMIT k`. 0 means no limit.
+	TopK uint64
 }
 
 func newMetricTableExtractor() *MetricTableExtractor {
@@ -977,11 +980,14 @@ func (e *MetricTableExtractor) GetMetricTablePromQL(sctx sessionctx.Context, low
 		return ""
 	}
 	if len(quantiles) == 0 {
-		quantiles = []float64{def.Quantile}
+		quantiles = def.DefaultQuantiles()
 	}
 	var buf bytes.Buffer
 	for i, quantile := range quantiles {
 		promQL := def.GenPromQL(sctx, e.LabelConditions, quantile)
+		if e.TopK > 0 {
+			promQL = infoschema.GenTopKPromQL(promQL, e.TopK)
+		}
 		if i > 0 {
 			buf.WriteByte(',')
 		}
@@ -603,6 +603,12 @@ func TestMetricTableExtractor(t *testing.T) {
 			startTime: parseTime(t, "2019-10-10 10:10:10.001"),
 			endTime:   parseTime(t, "2019-10-11 10:10:09.999"),
 		},
+		{
+			sql:       "select * from metrics_schema.tidb_query_duration where time between '2019-10-10 10:10:10' and '2019-10-10 12:10:10'",
+			promQL:    `histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))`,
+			startTime: parseTime(t, "2019-10-10 10:10:10"),
+			endTime:   parseTime(t, "2019-10-10 12:10:10"),
+		},
 		{
 			sql:       "select * from metrics_schema.tidb_query_duration where time>='2019-10-10 10:10:10'",
 			promQL:    `histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))`,
@@ -628,6 +634,11 @@ func TestMetricTableExtractor(t *testing.T) {
 				"histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))",
 			quantiles: []float64{0.8, 0.9},
 		},
+		{
+			sql:       "select * from metrics_schema.tidb_query_duration where quantile=0.95",
+			promQL:    "histogram_quantile(0.95, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))",
+			quantiles: []float64{0.95},
+		},
 		{
 			sql:       "select * from metrics_schema.tidb_query_duration where quantile=0",
 			promQL:    "histogram_quantile(0, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))",
@@ -661,6 +672,53 @@ func TestMetricTableExtractor(t *testing.T) {
 	}
 }
 
+func TestMetricTableExtractorTopK(t *testing.T) {
+	store, dom := testkit.CreateMockStoreAndDomain(t)
+
+	se, err := session.CreateSession4Test(store)
+	require.NoError(t, err)
+
+	parser := parser.New()
+	var cases = []struct {
+		sql    string
+		topK   uint64
+		promQL string
+	}{
+		{
+			sql:    "select * from metrics_schema.tidb_query_duration order by value desc limit 3",
+			topK:   3,
+			promQL: "topk(3, histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance)))",
+		},
+		{
+			sql:    "select * from metrics_schema.tidb_query_duration order by value desc limit 2, 3",
+			topK:   5,
+			promQL: "topk(5, histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance)))",
+		},
+		{
+			// The NaN values are read as NULL and sorted first, which are dropped by `bottomk`.
+			sql:    "select * from metrics_schema.tidb_query_duration order by value limit 3",
+			promQL: "histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))",
+		},
+		{
+			sql:    "select * from metrics_schema.tidb_query_duration order by time desc limit 3",
+			promQL: "histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))",
+		},
+		{
+			sql:    "select * from metrics_schema.tidb_query_duration order by value, time desc limit 3",
+			promQL: "histogram_quantile(0.9, sum(rate(tidb_server_handle_query_duration_seconds_bucket{}[60s])) by (le,sql_type,instance))",
+		},
+	}
+	for _, ca := range cases {
+		logicalMemTable := getLogicalMemTable(t, dom, se, parser, ca.sql)
+		require.NotNil(t, logicalMemTable.Extractor)
+
+		metricTableExtractor := logicalMemTable.Extractor.(*plannercore.MetricTableExtractor)
+		require.Equal(t, ca.topK, metricTableExtractor.TopK, "SQL: %v", ca.sql)
+		promQL := metricTableExtractor.GetMetricTablePromQL(se, "tidb_query_duration")
+		require.Equal(t, ca.promQL, promQL, "SQL: %v", ca.sql)
+	}
+}
+
 func TestMetricsSummaryTableExtractor(t *testing.T) {
 	store, dom := testkit.CreateMockStoreAndDomain(t)
 
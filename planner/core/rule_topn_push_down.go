@@ -50,6 +50,25 @@ func (p *LogicalCTE) pushDownTopN(topN *LogicalTopN, opt *logicalOptimizeOp) Log
 	return p
 }
 
+// pushDownTopN implements the LogicalPlan interface.
+// The topN ordering by the value column of a metric table descendingly is also pushed to Prometheus by `topk`, but the
+// topN is kept since `topk` selects the series at every timestamp rather than in the whole time range. The ascending
+// one is not pushed down by `bottomk`, since the NaN values, which are read as NULL and sorted first, are dropped by it.
+func (p *LogicalMemTable) pushDownTopN(topN *LogicalTopN, opt *logicalOptimizeOp) LogicalPlan {
+	if topN == nil {
+		return p.self
+	}
+	if e, ok := p.Extractor.(*MetricTableExtractor); ok && len(topN.ByItems) == 1 && topN.ByItems[0].Desc &&
+		len(topN.GetPartitionBy()) == 0 {
+		if col, ok := topN.ByItems[0].Expr.(*expression.Column); ok {
+			if idx := p.schema.ColumnIndex(col); idx >= 0 && p.names[idx].ColName.L == "value" {
+				e.TopK = topN.Count + topN.Offset
+			}
+		}
+	}
+	return topN.setChild(p.self, opt)
+}
+
 // setChild set p as topn's child.
 func (lt *LogicalTopN) setChild(p LogicalPlan, opt *logicalOptimizeOp) LogicalPlan {
 	// Remove this TopN if its child is a TableDual.
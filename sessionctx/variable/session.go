@@ -1156,6 +1156,18 @@ type SessionVars struct {
 	// MetricSchemaRangeDuration indicates the step when query metric schema.
 	MetricSchemaRangeDuration int64
 
+	// MetricSchemaExtraLabelConditions indicates the label matchers added to the label conditions when query metric schema.
+	MetricSchemaExtraLabelConditions []MetricLabelMatcher
+
+	// MetricSchemaOffset indicates the offset of the metric data when query metric schema.
+	MetricSchemaOffset time.Duration
+
+	// MetricSchemaErrorAsRow indicates whether the failed metric query is reported as a row of the metric table.
+	MetricSchemaErrorAsRow bool
+
+	// MetricSchemaMaxPromQLLen indicates the max length of the generated PromQL when query metric schema, 0 means without limit.
+	MetricSchemaMaxPromQLLen int
+
 	// Some data of cluster-level memory tables will be retrieved many times in different inspection rules,
 	// and the cost of retrieving some data is expensive. We use the `TableSnapshot` to cache those data
 	// and obtain them lazily, and provide a consistent view of inspection tables for each inspection rules.
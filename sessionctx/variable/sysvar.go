@@ -344,6 +344,35 @@ var defaultSysVars = []*SysVar{
 		s.MetricSchemaRangeDuration = TidbOptInt64(val, DefTiDBMetricSchemaRangeDuration)
 		return nil
 	}},
+	{Scope: ScopeSession, Name: TiDBMetricSchemaExtraLabelConditions, Value: "", Type: TypeStr, Validation: func(vars *SessionVars, normalizedValue string, originalValue string, scope ScopeFlag) (string, error) {
+		if _, err := ParseMetricLabelMatchers(normalizedValue); err != nil {
+			return normalizedValue, ErrWrongValueForVar.GenWithStackByArgs(TiDBMetricSchemaExtraLabelConditions, originalValue)
+		}
+		return normalizedValue, nil
+	}, SetSession: func(s *SessionVars, val string) error {
+		matchers, err := ParseMetricLabelMatchers(val)
+		if err != nil {
+			return err
+		}
+		s.MetricSchemaExtraLabelConditions = matchers
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBMetricSchemaOffset, Value: "0s", Type: TypeDuration, MinValue: 0, MaxValue: uint64(time.Hour * 24 * 365), SetSession: func(s *SessionVars, val string) error {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		s.MetricSchemaOffset = d
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBMetricSchemaErrorAsRow, Value: BoolToOnOff(DefTiDBMetricSchemaErrorAsRow), Type: TypeBool, SetSession: func(s *SessionVars, val string) error {
+		s.MetricSchemaErrorAsRow = TiDBOptOn(val)
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBMetricSchemaMaxPromQLLen, Value: strconv.Itoa(DefTiDBMetricSchemaMaxPromQLLen), Type: TypeUnsigned, MinValue: 0, MaxValue: math.MaxInt32, SetSession: func(s *SessionVars, val string) error {
+		s.MetricSchemaMaxPromQLLen = TidbOptInt(val, DefTiDBMetricSchemaMaxPromQLLen)
+		return nil
+	}},
 	{Scope: ScopeSession, Name: TiDBFoundInPlanCache, Value: BoolToOnOff(DefTiDBFoundInPlanCache), Type: TypeBool, ReadOnly: true, GetSession: func(s *SessionVars) (string, error) {
 		return BoolToOnOff(s.PrevFoundInPlanCache), nil
 	}},
@@ -1289,3 +1289,54 @@ func TestTiDBTiFlashReplicaRead(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, DefTiFlashReplicaRead, val)
 }
+
+func TestTiDBMetricSchemaExtraLabelConditions(t *testing.T) {
+	sv := GetSysVar(TiDBMetricSchemaExtraLabelConditions)
+	vars := NewSessionVars(nil)
+
+	val, err := sv.Validate(vars, `tenant=x, zone != "a\"b,c"`, ScopeSession)
+	require.NoError(t, err)
+	require.NoError(t, sv.SetSessionFromHook(vars, val))
+	require.Equal(t, []MetricLabelMatcher{
+		{Label: "tenant", Op: "=", Value: "x"},
+		{Label: "zone", Op: "!=", Value: `a"b,c`},
+	}, vars.MetricSchemaExtraLabelConditions)
+
+	require.NoError(t, sv.SetSessionFromHook(vars, ""))
+	require.Empty(t, vars.MetricSchemaExtraLabelConditions)
+
+	for _, malformed := range []string{
+		`tenant=~".*"`,
+		`tenant!~"x"`,
+		`{tenant="x"}`,
+		`tenant`,
+		`tenant="x`,
+		`tenant=x y`,
+		`tenant="x" zone="y"`,
+		`tenant="x",`,
+		`1tenant="x"`,
+		`tenant=`,
+	} {
+		_, err = sv.Validate(vars, malformed, ScopeSession)
+		require.Errorf(t, err, "value %s", malformed)
+	}
+}
+
+func TestTiDBMetricSchemaOffset(t *testing.T) {
+	sv := GetSysVar(TiDBMetricSchemaOffset)
+	vars := NewSessionVars(nil)
+
+	val, err := sv.Validate(vars, "1h", ScopeSession)
+	require.NoError(t, err)
+	require.Equal(t, "1h0m0s", val)
+	require.NoError(t, sv.SetSessionFromHook(vars, val))
+	require.Equal(t, time.Hour, vars.MetricSchemaOffset)
+
+	_, err = sv.Validate(vars, "1 hour", ScopeSession)
+	require.Error(t, err)
+
+	// The negative offset is truncated to 0.
+	val, err = sv.Validate(vars, "-1h", ScopeSession)
+	require.NoError(t, err)
+	require.Equal(t, "0s", val)
+}
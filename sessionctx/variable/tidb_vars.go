@@ -613,6 +613,23 @@ const (
 	// TiDBMetricSchemaRangeDuration indicates the range duration when query metric schema.
 	TiDBMetricSchemaRangeDuration = "tidb_metric_query_range_duration"
 
+	// TiDBMetricSchemaExtraLabelConditions indicates the label matchers added to the label conditions when query metric schema,
+	// e.g. `tenant="x"` forces all the metric queries to read the metrics of the tenant x.
+	TiDBMetricSchemaExtraLabelConditions = "tidb_metric_query_extra_label_conditions"
+
+	// TiDBMetricSchemaOffset indicates the offset of the metric data when query metric schema, e.g. `1h` reads the
+	// metric data of one hour ago, it is used by the metric tables whose PromQL contains the `$OFFSET` modifier.
+	TiDBMetricSchemaOffset = "tidb_metric_query_offset"
+
+	// TiDBMetricSchemaErrorAsRow indicates whether the failed metric table returns a single row with the error in the
+	// hidden `_error` column and a warning instead of failing the statement, e.g. for the dashboards querying many
+	// metric tables.
+	TiDBMetricSchemaErrorAsRow = "tidb_metric_query_error_as_row"
+
+	// TiDBMetricSchemaMaxPromQLLen indicates the max length of the generated PromQL when query metric schema,
+	// the metric query is rejected if its PromQL is longer than it, 0 means without limit.
+	TiDBMetricSchemaMaxPromQLLen = "tidb_metric_query_max_promql_len"
+
 	// TiDBEnableCollectExecutionInfo indicates that whether execution info is collected.
 	TiDBEnableCollectExecutionInfo = "tidb_enable_collect_execution_info"
 
@@ -1213,6 +1230,8 @@ const (
 	DefTiDBStoreLimit                              = 0
 	DefTiDBMetricSchemaStep                        = 60 // 60s
 	DefTiDBMetricSchemaRangeDuration               = 60 // 60s
+	DefTiDBMetricSchemaErrorAsRow                  = false
+	DefTiDBMetricSchemaMaxPromQLLen                = 0
 	DefTiDBFoundInPlanCache                        = false
 	DefTiDBFoundInBinding                          = false
 	DefTiDBEnableCollectExecutionInfo              = true
@@ -612,3 +612,81 @@ func ParseAnalyzeSkipColumnTypes(val string) map[string]struct{} {
 	}
 	return skipTypes
 }
+
+// MetricLabelMatcher is a label matcher of tidb_metric_query_extra_label_conditions.
+type MetricLabelMatcher struct {
+	Label string
+	// Op is `=` or `!=`, the regular expression matchers are not allowed since they could match all the values,
+	// e.g. `tenant=~".*"`, which defeats forcing the label.
+	Op    string
+	Value string
+}
+
+// ParseMetricLabelMatchers parses tidb_metric_query_extra_label_conditions, which is a comma separated list of the
+// label matchers like `tenant="x"`, the value may be unquoted if it doesn't contain the special characters.
+func ParseMetricLabelMatchers(val string) ([]MetricLabelMatcher, error) {
+	var matchers []MetricLabelMatcher
+	s := strings.TrimSpace(val)
+	for len(s) > 0 {
+		var m MetricLabelMatcher
+		i := 0
+		for i < len(s) && (s[i] == '_' || s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' ||
+			i > 0 && s[i] >= '0' && s[i] <= '9') {
+			i++
+		}
+		if i == 0 {
+			return nil, errors.Errorf("invalid label name in %q", s)
+		}
+		m.Label = s[:i]
+		s = strings.TrimSpace(s[i:])
+		switch {
+		case strings.HasPrefix(s, "=~"), strings.HasPrefix(s, "!~"):
+			return nil, errors.Errorf("the regular expression matcher of label %s is not allowed", m.Label)
+		case strings.HasPrefix(s, "!="):
+			m.Op, s = "!=", s[2:]
+		case strings.HasPrefix(s, "="):
+			m.Op, s = "=", s[1:]
+		default:
+			return nil, errors.Errorf("invalid matcher of label %s", m.Label)
+		}
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.Errorf("unterminated value of label %s", m.Label)
+			}
+			value, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, errors.Errorf("invalid value of label %s: %v", m.Label, err)
+			}
+			m.Value, s = value, s[end+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			m.Value, s = strings.TrimSpace(s[:end]), s[end:]
+			if len(m.Value) == 0 || strings.ContainsAny(m.Value, "\"'`\\{}[]() =!~") {
+				return nil, errors.Errorf("invalid value of label %s, please quote it", m.Label)
+			}
+		}
+		matchers = append(matchers, m)
+		s = strings.TrimSpace(s)
+		if len(s) > 0 {
+			if s[0] != ',' {
+				return nil, errors.Errorf("the label matchers should be separated by comma, but got %q", s)
+			}
+			s = strings.TrimSpace(s[1:])
+			if len(s) == 0 {
+				return nil, errors.New("the label matchers should not end with comma")
+			}
+		}
+	}
+	return matchers, nil
+}
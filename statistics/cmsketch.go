@@ -16,13 +16,19 @@ package statistics
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
@@ -39,6 +45,7 @@ import (
 	"github.com/pingcap/tidb/util/mathutil"
 	"github.com/pingcap/tipb/go-tipb"
 	"github.com/twmb/murmur3"
+	atomicutil "go.uber.org/atomic"
 	"golang.org/x/exp/slices"
 )
 
@@ -48,6 +55,8 @@ const topNThreshold = uint64(10)
 var (
 	// ErrQueryInterrupted indicates interrupted
 	ErrQueryInterrupted = dbterror.ClassExecutor.NewStd(mysql.ErrQueryInterrupted)
+	// ErrMergeTopNTimeout indicates the merge of the partition-level TopNs exceeds its deadline.
+	ErrMergeTopNTimeout = dbterror.ClassExecutor.NewStd(mysql.ErrMaxExecTimeExceeded)
 )
 
 // CMSketch is used to estimate point queries.
@@ -78,6 +87,189 @@ func NewCMSketch(d, w int32) *CMSketch {
 	return &CMSketch{depth: d, width: w, table: tbl}
 }
 
+// maxSuggestedCMSketchDimension is the max depth and width returned by SuggestCMSketchDimensions.
+const maxSuggestedCMSketchDimension = 1 << 20
+
+// SuggestCMSketchDimensions returns the depth and width of the CMSketch by the standard bounds w = ceil(e / epsilon)
+// and d = ceil(ln(1 / delta)): the estimation of a value exceeds its count by more than epsilon * count of the
+// CMSketch with a probability of at most delta. The depth is at least 1, and both are at most 2^20.
+func SuggestCMSketchDimensions(epsilon, delta float64) (d, w int32) {
+	width, depth := float64(maxSuggestedCMSketchDimension), float64(maxSuggestedCMSketchDimension)
+	if epsilon > 0 {
+		width = math.Min(width, math.Ceil(math.E/epsilon))
+	}
+	if delta > 0 {
+		depth = math.Min(depth, math.Ceil(math.Log(1/delta)))
+	}
+	return int32(math.Max(depth, 1)), int32(math.Max(width, 1))
+}
+
+const (
+	// autoCMSketchDepth is the depth of the CMSketch created by NewCMSketchAuto, the same as the default depth.
+	autoCMSketchDepth = 5
+	// minAutoCMSketchWidth is the min width of the CMSketch created by NewCMSketchAuto.
+	minAutoCMSketchWidth = 256
+)
+
+// NewCMSketchAuto returns a new CMSketch whose width is chosen by the expected number of the distinct values and
+// the skew, i.e. the zipf factor, of the data. It targets the error budget that the average error of the estimations
+// is within the average count of the values. The width is 2 * expectedDistinct / skew, so that there are about half
+// a value in each counter for the uniform data; the skewed data needs a narrower CMSketch since the most rows are
+// taken by a few values, and the count-mean-min estimation removes the noise of the light tail. The skew less than 1
+// is regarded as 1, the width is in [256, 2^20] and the depth is always 5.
+func NewCMSketchAuto(expectedDistinct uint64, skew float64) *CMSketch {
+	skew = math.Max(skew, 1)
+	width := math.Ceil(2 * float64(expectedDistinct) / skew)
+	width = math.Max(math.Min(width, maxSuggestedCMSketchDimension), minAutoCMSketchWidth)
+	return NewCMSketch(autoCMSketchDepth, int32(width))
+}
+
+// VersionedCMSketch wraps a CMSketch which is updated in the background and read concurrently.
+// The wrapped CMSketch should never be modified after it is stored, the writers should update a copy
+// of it and store the copy, so the readers always see a consistent snapshot.
+type VersionedCMSketch struct {
+	cms atomic.Pointer[CMSketch]
+}
+
+// NewVersionedCMSketch returns a new VersionedCMSketch wrapping the given CMSketch.
+func NewVersionedCMSketch(c *CMSketch) *VersionedCMSketch {
+	v := &VersionedCMSketch{}
+	v.Store(c)
+	return v
+}
+
+// Load returns the current snapshot of the CMSketch.
+func (v *VersionedCMSketch) Load() *CMSketch {
+	return v.cms.Load()
+}
+
+// Store atomically replaces the CMSketch with `c`.
+func (v *VersionedCMSketch) Store(c *CMSketch) {
+	v.cms.Store(c)
+}
+
+// cellIndex returns the column of the `row`-th row which the value hashed into (h1, h2) is counted in.
+func cellIndex(h1, h2 uint64, row int, width int32) uint64 {
+	return (h1 + h2*uint64(row)) % uint64(width)
+}
+
+// FloatCMSketch is a CMSketch whose counters are float64, it is used to count the weighted rows, e.g. the
+// rows sampled with different probabilities. It shares the hashing with the CMSketch, so the same value is
+// counted in the same cells of both sketches.
+type FloatCMSketch struct {
+	table [][]float64
+	count float64
+	depth int32
+	width int32
+}
+
+// NewFloatCMSketch returns a new FloatCMSketch.
+func NewFloatCMSketch(d, w int32) *FloatCMSketch {
+	tbl := make([][]float64, d)
+	arena := make([]float64, d*w)
+	for i := range tbl {
+		tbl[i] = arena[i*int(w) : (i+1)*int(w)]
+	}
+	return &FloatCMSketch{depth: d, width: w, table: tbl}
+}
+
+// InsertWeighted adds the bytes value into the FloatCMSketch by the weight.
+func (c *FloatCMSketch) InsertWeighted(bytes []byte, weight float64) {
+	h1, h2 := murmur3.Sum128(bytes)
+	c.count += weight
+	for i := range c.table {
+		j := cellIndex(h1, h2, i, c.width)
+		c.table[i][j] += weight
+	}
+}
+
+// QueryValue returns the estimated sum of the weights of the bytes value, which is the minimum of its counters.
+func (c *FloatCMSketch) QueryValue(bytes []byte) float64 {
+	h1, h2 := murmur3.Sum128(bytes)
+	result := math.MaxFloat64
+	for i := range c.table {
+		j := cellIndex(h1, h2, i, c.width)
+		result = math.Min(result, c.table[i][j])
+	}
+	return result
+}
+
+// TotalCount returns the sum of the weights inserted into the FloatCMSketch.
+func (c *FloatCMSketch) TotalCount() float64 {
+	return c.count
+}
+
+// HybridCMSketch keeps the exact counts of the keys seen fewer than `threshold` times, and only spills a key to
+// the wrapped CMSketch once its count reaches the threshold, which improves the accuracy for the long tail.
+// The numbers of the exactly counted keys and the spilled keys are bounded by `maxExactKeys`, the keys beyond it go
+// to the CMSketch directly.
+// A key having any occurrence in the CMSketch is never counted exactly again, otherwise its exact count would hide
+// the occurrences in the CMSketch.
+type HybridCMSketch struct {
+	cms   *CMSketch
+	exact map[string]uint64
+	// spilled records the keys spilled to the CMSketch, their following occurrences go to the CMSketch directly.
+	// It's bounded by `maxExactKeys` too.
+	spilled map[string]struct{}
+	// full is set once the number of the exactly counted keys or the spilled keys reaches `maxExactKeys`, after that
+	// the new keys go to the CMSketch directly even if some keys are spilled, since they may have been inserted to the
+	// CMSketch. So the keys spilled after it's set don't need to be recorded.
+	full         bool
+	threshold    uint64
+	maxExactKeys int
+}
+
+// NewHybridCMSketch returns a new HybridCMSketch wrapping a CMSketch of the given depth and width.
+func NewHybridCMSketch(d, w int32, threshold uint64, maxExactKeys int) *HybridCMSketch {
+	return &HybridCMSketch{
+		cms:          NewCMSketch(d, w),
+		exact:        make(map[string]uint64),
+		spilled:      make(map[string]struct{}),
+		threshold:    threshold,
+		maxExactKeys: maxExactKeys,
+	}
+}
+
+// InsertBytes inserts the bytes value into the HybridCMSketch.
+func (h *HybridCMSketch) InsertBytes(bytes []byte) {
+	if _, ok := h.spilled[string(bytes)]; ok {
+		h.cms.InsertBytes(bytes)
+		return
+	}
+	count, ok := h.exact[string(bytes)]
+	if !ok && (h.full || len(h.exact) >= h.maxExactKeys) {
+		h.full = true
+		h.cms.InsertBytes(bytes)
+		return
+	}
+	count++
+	if count >= h.threshold {
+		delete(h.exact, string(bytes))
+		if !h.full && len(h.spilled) < h.maxExactKeys {
+			h.spilled[string(bytes)] = struct{}{}
+		} else {
+			h.full = true
+		}
+		h.cms.InsertBytesByCount(bytes, count)
+		return
+	}
+	h.exact[string(bytes)] = count
+}
+
+// QueryValue returns the exact count of the bytes value if it is still exactly counted, otherwise the estimation
+// of the CMSketch.
+func (h *HybridCMSketch) QueryValue(bytes []byte) uint64 {
+	if count, ok := h.exact[string(bytes)]; ok {
+		return count
+	}
+	return h.cms.QueryBytes(bytes)
+}
+
+// CMSketch returns the wrapped CMSketch, the exactly counted keys are not included.
+func (h *HybridCMSketch) CMSketch() *CMSketch {
+	return h.cms
+}
+
 // topNHelper wraps some variables used when building cmsketch with top n.
 type topNHelper struct {
 	sorted        []dataCnt
@@ -92,6 +284,11 @@ func newTopNHelper(sample [][]byte, numTop uint32) *topNHelper {
 	for i := range sample {
 		counter[hack.String(sample[i])]++
 	}
+	return newTopNHelperFromCounter(counter, uint64(len(sample)), numTop)
+}
+
+// newTopNHelperFromCounter builds the topNHelper from the counts of the distinct values in the sample of `sampleSize`.
+func newTopNHelperFromCounter(counter map[hack.MutableString]uint64, sampleSize uint64, numTop uint32) *topNHelper {
 	sorted, onlyOnceItems := make([]dataCnt, 0, len(counter)), uint64(0)
 	for key, cnt := range counter {
 		sorted = append(sorted, dataCnt{hack.Slice(string(key)), cnt})
@@ -133,11 +330,18 @@ func newTopNHelper(sample [][]byte, numTop uint32) *topNHelper {
 		sumTopN += sorted[actualNumTop].cnt
 	}
 
-	return &topNHelper{sorted, uint64(len(sample)), onlyOnceItems, sumTopN, actualNumTop}
+	return &topNHelper{sorted, sampleSize, onlyOnceItems, sumTopN, actualNumTop}
 }
 
 // NewCMSketchAndTopN returns a new CM sketch with TopN elements, the estimate NDV and the scale ratio.
 func NewCMSketchAndTopN(d, w int32, sample [][]byte, numTop uint32, rowCount uint64) (*CMSketch, *TopN, uint64, uint64) {
+	return NewCMSketchAndTopNWithCapacity(d, w, sample, numTop, rowCount, 0)
+}
+
+// NewCMSketchAndTopNWithCapacity is NewCMSketchAndTopN, but the TopN is allocated with the capacity of at least `topNCap`
+// entries, so the callers knowing the number of the heavy hitters, e.g. to merge more TopN entries later, can avoid
+// growing the TopN again.
+func NewCMSketchAndTopNWithCapacity(d, w int32, sample [][]byte, numTop uint32, rowCount uint64, topNCap int) (*CMSketch, *TopN, uint64, uint64) {
 	if rowCount == 0 || len(sample) == 0 {
 		return nil, nil, 0, 0
 	}
@@ -147,15 +351,24 @@ func NewCMSketchAndTopN(d, w int32, sample [][]byte, numTop uint32, rowCount uin
 	rowCount = mathutil.Max(rowCount, uint64(len(sample)))
 	estimateNDV, scaleRatio := calculateEstimateNDV(helper, rowCount)
 	defaultVal := calculateDefaultVal(helper, estimateNDV, scaleRatio, rowCount)
-	c, t := buildCMSAndTopN(helper, d, w, scaleRatio, defaultVal)
+	c, t := buildCMSAndTopN(helper, d, w, scaleRatio, defaultVal, topNCap)
 	return c, t, estimateNDV, scaleRatio
 }
 
-func buildCMSAndTopN(helper *topNHelper, d, w int32, scaleRatio uint64, defaultVal uint64) (c *CMSketch, t *TopN) {
+func buildCMSAndTopN(helper *topNHelper, d, w int32, scaleRatio uint64, defaultVal uint64, topNCap int) (c *CMSketch, t *TopN) {
 	c = NewCMSketch(d, w)
+	t = buildTopNFromHelper(helper, scaleRatio, topNCap)
+	c.defaultValue = defaultVal
+	insertDataCnts(c, helper.sorted, scaleRatio, defaultVal)
+	return
+}
+
+// buildTopNFromHelper builds the TopN from the most frequent values of the helper if they are frequent enough,
+// and removes them from the helper.
+func buildTopNFromHelper(helper *topNHelper, scaleRatio uint64, topNCap int) (t *TopN) {
 	enableTopN := helper.sampleSize/topNThreshold <= helper.sumTopN
 	if enableTopN {
-		t = NewTopN(int(helper.actualNumTop))
+		t = NewTopN(mathutil.Max(int(helper.actualNumTop), topNCap))
 		for i := uint32(0); i < helper.actualNumTop; i++ {
 			data, cnt := helper.sorted[i].data, helper.sorted[i].cnt
 			t.AppendTopN(data, cnt*scaleRatio)
@@ -163,9 +376,13 @@ func buildCMSAndTopN(helper *topNHelper, d, w int32, scaleRatio uint64, defaultV
 		t.Sort()
 		helper.sorted = helper.sorted[helper.actualNumTop:]
 	}
-	c.defaultValue = defaultVal
-	for i := range helper.sorted {
-		data, cnt := helper.sorted[i].data, helper.sorted[i].cnt
+	return
+}
+
+// insertDataCnts inserts the sampled values into the CMSketch with their counts scaled to the whole table.
+func insertDataCnts(c *CMSketch, sorted []dataCnt, scaleRatio uint64, defaultVal uint64) {
+	for i := range sorted {
+		data, cnt := sorted[i].data, sorted[i].cnt
 		// If the value only occurred once in the sample, we assumes that there is no difference with
 		// value that does not occurred in the sample.
 		rowCount := defaultVal
@@ -174,7 +391,70 @@ func buildCMSAndTopN(helper *topNHelper, d, w int32, scaleRatio uint64, defaultV
 		}
 		c.InsertBytesByCount(data, rowCount)
 	}
-	return
+}
+
+// NewCMSketchAndTopNParallel is NewCMSketchAndTopN, but the sample is counted and inserted into the CMSketch by
+// `concurrency` goroutines, each of them builds a local CMSketch on its shard, and they are merged by MergeCMSketch.
+// The TopN is still chosen by the frequencies in the whole sample, and the addition of the counters is commutative,
+// so the result is exactly the same as NewCMSketchAndTopN.
+func NewCMSketchAndTopNParallel(d, w int32, sample [][]byte, numTop uint32, rowCount uint64, concurrency int) (*CMSketch, *TopN, uint64, uint64) {
+	if concurrency <= 1 {
+		return NewCMSketchAndTopN(d, w, sample, numTop, rowCount)
+	}
+	if rowCount == 0 || len(sample) == 0 {
+		return nil, nil, 0, 0
+	}
+	helper := newTopNHelperFromCounter(countSampleParallel(sample, concurrency), uint64(len(sample)), numTop)
+	rowCount = mathutil.Max(rowCount, uint64(len(sample)))
+	estimateNDV, scaleRatio := calculateEstimateNDV(helper, rowCount)
+	defaultVal := calculateDefaultVal(helper, estimateNDV, scaleRatio, rowCount)
+	t := buildTopNFromHelper(helper, scaleRatio, 0)
+
+	shards := make([]*CMSketch, concurrency)
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			begin, end := len(helper.sorted)*i/concurrency, len(helper.sorted)*(i+1)/concurrency
+			shards[i] = NewCMSketch(d, w)
+			insertDataCnts(shards[i], helper.sorted[begin:end], scaleRatio, defaultVal)
+		}(i)
+	}
+	wg.Wait()
+	c := shards[0]
+	for _, shard := range shards[1:] {
+		// The dimensions are the same, so it never fails.
+		_ = c.MergeCMSketch(shard)
+	}
+	c.defaultValue = defaultVal
+	return c, t, estimateNDV, scaleRatio
+}
+
+// countSampleParallel counts the distinct values in the sample by `concurrency` goroutines.
+func countSampleParallel(sample [][]byte, concurrency int) map[hack.MutableString]uint64 {
+	counters := make([]map[hack.MutableString]uint64, concurrency)
+	var wg sync.WaitGroup
+	for i := range counters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			begin, end := len(sample)*i/concurrency, len(sample)*(i+1)/concurrency
+			counter := make(map[hack.MutableString]uint64, end-begin)
+			for _, data := range sample[begin:end] {
+				counter[hack.String(data)]++
+			}
+			counters[i] = counter
+		}(i)
+	}
+	wg.Wait()
+	counter := counters[0]
+	for _, c := range counters[1:] {
+		for key, cnt := range c {
+			counter[key] += cnt
+		}
+	}
+	return counter
 }
 
 func calculateDefaultVal(helper *topNHelper, estimateNDV, scaleRatio, rowCount uint64) uint64 {
@@ -198,21 +478,73 @@ func (c *CMSketch) MemoryUsage() (sum int64) {
 	return
 }
 
+// EmptyCMSketchSize is the size of empty CMSketch.
+const EmptyCMSketchSize = int64(unsafe.Sizeof(CMSketch{}))
+
+// cmSketchRowHeaderSize is the size of the slice header of each row in CMSketch.table.
+const cmSketchRowHeaderSize = int64(unsafe.Sizeof([]uint32{}))
+
+// MemUsage returns the approximate heap bytes held by the CMSketch for the analyze memory tracker. It's the
+// MemoryUsage of the counters used by the stats cache plus the struct and the slice headers of the rows.
+func (c *CMSketch) MemUsage() int64 {
+	if c == nil {
+		return 0
+	}
+	return EmptyCMSketchSize + int64(c.depth)*cmSketchRowHeaderSize + c.MemoryUsage()
+}
+
 // InsertBytes inserts the bytes value into the CM Sketch.
 func (c *CMSketch) InsertBytes(bytes []byte) {
 	c.InsertBytesByCount(bytes, 1)
 }
 
+// InsertDatum inserts the datum into the CM Sketch, the datum is encoded by codec.EncodeKey, which is memory-comparable,
+// so the floats and decimals equal in value are encoded to the same bytes, and the TopN built from the encoded values
+// can be range-queried. The datum should be queried by the same encoding.
+func (c *CMSketch) InsertDatum(sc *stmtctx.StatementContext, d *types.Datum) error {
+	bytes, err := codec.EncodeKey(sc, nil, *d)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.InsertBytes(bytes)
+	return nil
+}
+
 // InsertBytesByCount adds the bytes value into the TopN (if value already in TopN) or CM Sketch by delta, this does not updates c.defaultValue.
 func (c *CMSketch) InsertBytesByCount(bytes []byte, count uint64) {
 	h1, h2 := murmur3.Sum128(bytes)
+	c.insertHashValue(h1, h2, count)
+}
+
+func (c *CMSketch) insertHashValue(h1, h2 uint64, count uint64) {
 	c.count += count
 	for i := range c.table {
-		j := (h1 + h2*uint64(i)) % uint64(c.width)
+		j := cellIndex(h1, h2, i, c.width)
 		c.table[i][j] += uint32(count)
 	}
 }
 
+// InsertHash64 inserts the value by its 64-bit digest, e.g. the hash of a wide key, so the callers don't need to keep
+// or hash the whole key. The values with the same digest are counted as the same one, so the collisions of the digest
+// cause overestimation in addition to the collisions of the CMSketch. The values inserted by InsertHash64 should be
+// queried by QueryHash64, since the CMSketch is hashed differently from InsertBytes.
+func (c *CMSketch) InsertHash64(h uint64) {
+	h1, h2 := hash64ToHashValue(h)
+	c.insertHashValue(h1, h2, 1)
+}
+
+// QueryHash64 queries the count of the value inserted by InsertHash64.
+func (c *CMSketch) QueryHash64(h uint64) uint64 {
+	h1, h2 := hash64ToHashValue(h)
+	return c.queryHashValue(nil, h1, h2)
+}
+
+func hash64ToHashValue(h uint64) (h1, h2 uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], h)
+	return murmur3.Sum128(buf[:])
+}
+
 func (c *CMSketch) considerDefVal(cnt uint64) bool {
 	return (cnt == 0 || (cnt > c.defaultValue && cnt < 2*(c.count/uint64(c.width)))) && c.defaultValue > 0
 }
@@ -246,7 +578,7 @@ func (c *CMSketch) setValue(h1, h2 uint64, count uint64) {
 	// let it overflow naturally
 	deltaCount := uint32(count) - uint32(oriCount)
 	for i := range c.table {
-		j := (h1 + h2*uint64(i)) % uint64(c.width)
+		j := cellIndex(h1, h2, i, c.width)
 		c.table[i][j] = c.table[i][j] + deltaCount
 	}
 }
@@ -255,11 +587,30 @@ func (c *CMSketch) setValue(h1, h2 uint64, count uint64) {
 func (c *CMSketch) SubValue(h1, h2 uint64, count uint64) {
 	c.count -= count
 	for i := range c.table {
-		j := (h1 + h2*uint64(i)) % uint64(c.width)
+		j := cellIndex(h1, h2, i, c.width)
 		c.table[i][j] = c.table[i][j] - uint32(count)
 	}
 }
 
+// SubBytes removes `count` rows of the bytes value from the CMSketch, e.g. for the deleted rows. Unlike SubValue,
+// the counters and the count saturate at zero instead of wrapping around. Since the counters of the value may be
+// shared with other values, the estimations are not the upper bounds any more after the subtraction.
+func (c *CMSketch) SubBytes(bytes []byte, count uint64) {
+	h1, h2 := murmur3.Sum128(bytes)
+	c.count = saturatingSub(c.count, count)
+	for i := range c.table {
+		j := cellIndex(h1, h2, i, c.width)
+		c.table[i][j] = uint32(saturatingSub(uint64(c.table[i][j]), count))
+	}
+}
+
+func saturatingSub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
 func queryValue(sctx sessionctx.Context, c *CMSketch, t *TopN, val types.Datum) (uint64, error) {
 	var sc *stmtctx.StatementContext
 	if sctx != nil {
@@ -276,6 +627,60 @@ func queryValue(sctx sessionctx.Context, c *CMSketch, t *TopN, val types.Datum)
 	return c.queryHashValue(sctx, h1, h2), nil
 }
 
+// SafeQueryValue is like queryValue on the encoded value, but it tolerates the missing stats. If both the CMSketch
+// and the TopN are nil, it falls back to `defaultSel*totalCount`, which is based on the row count only. Otherwise the
+// estimate is got from the TopN first and then the CMSketch, a value missed in the TopN-only stats is estimated as 0.
+func SafeQueryValue(cms *CMSketch, topN *TopN, defaultSel float64, totalCount uint64, bytes []byte) uint64 {
+	if cms == nil && topN == nil {
+		return uint64(defaultSel * float64(totalCount))
+	}
+	if ret, ok := topN.QueryTopN(nil, bytes); ok {
+		return ret
+	}
+	if cms == nil {
+		return 0
+	}
+	h1, h2 := murmur3.Sum128(bytes)
+	return cms.queryHashValue(nil, h1, h2)
+}
+
+// NotEqualSelectivity estimates the selectivity of the `!=` and `NOT IN` predicates on a single value,
+// which is `1 - estimate/totalCount` clamped to [0, 1], the estimate is got from the TopN first and then the CMSketch.
+func NotEqualSelectivity(sc *stmtctx.StatementContext, cms *CMSketch, topN *TopN, totalCount uint64, d types.Datum) (float64, error) {
+	if totalCount == 0 {
+		return 0, nil
+	}
+	bytes, err := tablecodec.EncodeValue(sc, nil, d)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	estimate, ok := topN.QueryTopN(nil, bytes)
+	if !ok && cms != nil {
+		h1, h2 := murmur3.Sum128(bytes)
+		estimate = cms.queryHashValue(nil, h1, h2)
+	}
+	selectivity := 1 - float64(estimate)/float64(totalCount)
+	return math.Max(0, math.Min(1, selectivity)), nil
+}
+
+// EstimateTransformed estimates the count of a predicate on a monotonic transform of the column, e.g.
+// `YEAR(col) = 2020`. The sketch is keyed on the column rather than the transformed value, so the caller
+// must enumerate the encoded column values mapping to the target transformed value, and their estimates,
+// got from the TopN first and then the CMSketch, are summed up.
+func EstimateTransformed(cms *CMSketch, topN *TopN, keys [][]byte) uint64 {
+	sum := uint64(0)
+	for _, key := range keys {
+		if count, ok := topN.QueryTopN(nil, key); ok {
+			sum += count
+			continue
+		}
+		if cms != nil {
+			sum += cms.QueryBytes(key)
+		}
+	}
+	return sum
+}
+
 // QueryBytes is used to query the count of specified bytes.
 func (c *CMSketch) QueryBytes(d []byte) uint64 {
 	failpoint.Inject("mockQueryBytesMaxUint64", func(val failpoint.Value) {
@@ -285,11 +690,173 @@ func (c *CMSketch) QueryBytes(d []byte) uint64 {
 	return c.queryHashValue(nil, h1, h2)
 }
 
+// QueryValueFloored returns the estimated count of the bytes value, which is the count in the TopN if the value is
+// in it. Otherwise, the estimation of the CMSketch is capped by the smallest count in the TopN, since the value would
+// be in the TopN if its count were larger, and it's at least the default value.
+func (c *CMSketch) QueryValueFloored(bytes []byte, topN *TopN) uint64 {
+	if count, ok := topN.QueryTopN(nil, bytes); ok {
+		return count
+	}
+	estimate := c.QueryBytes(bytes)
+	if topN.Num() > 0 {
+		smallest := uint64(math.MaxUint64)
+		for _, meta := range topN.TopN {
+			smallest = mathutil.Min(smallest, meta.Count)
+		}
+		estimate = mathutil.Min(estimate, smallest)
+	}
+	return mathutil.Max(estimate, c.defaultValue)
+}
+
+// QueryValueStrict returns the estimated count of the bytes value as QueryBytes, but it doesn't fall back to the
+// default value, so the value which isn't inserted is estimated as 0 unless it collides with the inserted ones.
+func (c *CMSketch) QueryValueStrict(bytes []byte) uint64 {
+	h1, h2 := murmur3.Sum128(bytes)
+	vals := make([]uint32, c.depth)
+	originVals := make([]uint32, c.depth)
+	result, _ := c.estimateHashValueWithBuf(h1, h2, vals, originVals)
+	return result
+}
+
+// QueryValueSaturated returns the estimated count of the bytes value as QueryBytes, and whether the minimum counter
+// of the value is math.MaxUint32, in which case the counters have overflowed and the estimation is meaningless.
+func (c *CMSketch) QueryValueSaturated(bytes []byte) (estimate uint64, saturated bool) {
+	h1, h2 := murmur3.Sum128(bytes)
+	min := uint32(math.MaxUint32)
+	for i := range c.table {
+		min = mathutil.Min(min, c.table[i][cellIndex(h1, h2, i, c.width)])
+	}
+	return c.queryHashValue(nil, h1, h2), len(c.table) > 0 && min == math.MaxUint32
+}
+
+// QueryValueWithConfidence returns the estimated count of the bytes value as QueryBytes, and the confidence of
+// the estimation in [0, 1], which is the ratio of the minimum counter to the mean of the counters in all rows.
+// If the rows agree on the count, the collisions are unlikely and the confidence is close to 1; if the counters
+// spread widely, the rows are inflated by the collisions differently and the estimation is less reliable.
+func (c *CMSketch) QueryValueWithConfidence(bytes []byte) (estimate uint64, confidence float64) {
+	h1, h2 := murmur3.Sum128(bytes)
+	min, sum := uint32(math.MaxUint32), uint64(0)
+	for i := range c.table {
+		counter := c.table[i][cellIndex(h1, h2, i, c.width)]
+		min = mathutil.Min(min, counter)
+		sum += uint64(counter)
+	}
+	estimate = c.queryHashValue(nil, h1, h2)
+	if sum == 0 {
+		// No value is hashed into the cells, the estimation is exact.
+		return estimate, 1
+	}
+	return estimate, float64(min) * float64(len(c.table)) / float64(sum)
+}
+
+// QueryBytesWithError returns the Count-Min estimation of the bytes value, i.e. the minimum counter of the value,
+// and the additive error bound of it, which is the expected noise per counter count/w. The estimation never
+// underestimates the count, and it's likely to overestimate no more than maxError, so the caller can widen the
+// selectivity interval by the maxError when the sketch is saturated. It's different from the estimation of QueryBytes
+// which eliminates the noise and may underestimate.
+func (c *CMSketch) QueryBytesWithError(bytes []byte) (estimate uint64, maxError uint64) {
+	if len(c.table) == 0 {
+		return 0, 0
+	}
+	h1, h2 := murmur3.Sum128(bytes)
+	min := uint32(math.MaxUint32)
+	for i := range c.table {
+		min = mathutil.Min(min, c.table[i][cellIndex(h1, h2, i, c.width)])
+	}
+	return uint64(min), c.count / uint64(c.width)
+}
+
+// RowEstimates returns the raw counters of the bytes value in all rows, the i-th element is the counter in the i-th
+// row. It is used to debug the overestimation: the row whose counter is much higher than the others is inflated by
+// the collisions, and the estimation of QueryBytes is derived from these counters.
+func (c *CMSketch) RowEstimates(bytes []byte) []uint32 {
+	h1, h2 := murmur3.Sum128(bytes)
+	counters := make([]uint32, len(c.table))
+	for i := range c.table {
+		counters[i] = c.table[i][cellIndex(h1, h2, i, c.width)]
+	}
+	return counters
+}
+
+// QueryValues returns the estimated counts of the given keys in the input order.
+// It shares the scratch buffers between the lookups, so it is cheaper than calling QueryBytes for each key.
+func (c *CMSketch) QueryValues(keys [][]byte) []uint64 {
+	results := make([]uint64, len(keys))
+	vals := make([]uint32, c.depth)
+	originVals := make([]uint32, c.depth)
+	for i, key := range keys {
+		h1, h2 := murmur3.Sum128(key)
+		results[i], _ = c.queryHashValueWithBuf(h1, h2, vals, originVals)
+	}
+	return results
+}
+
+// SumEstimateForKeys returns the sum of the estimated counts of the given keys, e.g. the candidate full keys sharing
+// an index prefix. The estimations may be overestimated by the collisions, so the sum is saturated at the count.
+func (c *CMSketch) SumEstimateForKeys(keys [][]byte) uint64 {
+	if c == nil {
+		return 0
+	}
+	sum := uint64(0)
+	for _, estimate := range c.QueryValues(keys) {
+		sum += estimate
+		if sum >= c.count {
+			return c.count
+		}
+	}
+	return sum
+}
+
+// MaxCMSketchIntRangeWidth is the max number of the integers in the range which QueryIntRangeSum estimates.
+var MaxCMSketchIntRangeWidth = atomicutil.NewInt64(1 << 10)
+
+// QueryIntRangeSum estimates the count of the integers in [low, high] by summing up the estimations of every integer,
+// e.g. for the `col BETWEEN low AND high` on a dense integer column. The error grows with the number of the integers,
+// so it refuses the range wider than MaxCMSketchIntRangeWidth, and the caller should use the histogram instead.
+func (c *CMSketch) QueryIntRangeSum(sc *stmtctx.StatementContext, low, high int64) (uint64, error) {
+	if low > high {
+		return 0, nil
+	}
+	// It doesn't overflow since high >= low.
+	rangeWidth := uint64(high) - uint64(low) + 1
+	if maxWidth := MaxCMSketchIntRangeWidth.Load(); rangeWidth == 0 || rangeWidth > uint64(maxWidth) {
+		return 0, errors.Errorf("the range [%d, %d] is wider than %d integers, use the histogram instead", low, high, maxWidth)
+	}
+	keys := make([][]byte, 0, rangeWidth)
+	for v := low; ; v++ {
+		key, err := tablecodec.EncodeValue(sc, nil, types.NewIntDatum(v))
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		keys = append(keys, key)
+		if v == high {
+			break
+		}
+	}
+	return c.SumEstimateForKeys(keys), nil
+}
+
+// EstimatedCollisionError returns the sum of the over-estimations of the given keys whose true counts are known,
+// e.g. a validation set of the sampled values. The over-estimations are caused by the collisions, so it shows how
+// much the collisions contribute to the error and whether the CMSketch should be wider or deeper.
+func (c *CMSketch) EstimatedCollisionError(keys [][]byte, trueCounts []uint64) (uint64, error) {
+	if len(keys) != len(trueCounts) {
+		return 0, errors.Errorf("the number of the keys %d mismatches the number of the true counts %d", len(keys), len(trueCounts))
+	}
+	if c == nil {
+		return 0, nil
+	}
+	sum := uint64(0)
+	for i, estimate := range c.QueryValues(keys) {
+		sum += saturatingSub(estimate, trueCounts[i])
+	}
+	return sum, nil
+}
+
 // The input sctx is just for debug trace, you can pass nil safely if that's not needed.
 func (c *CMSketch) queryHashValue(sctx sessionctx.Context, h1, h2 uint64) (result uint64) {
 	vals := make([]uint32, c.depth)
 	originVals := make([]uint32, c.depth)
-	min := uint32(math.MaxUint32)
 	useDefaultValue := false
 	if sctx != nil && sctx.GetSessionVars().StmtCtx.EnableOptimizerDebugTrace {
 		debugtrace.EnterContextCommon(sctx)
@@ -303,11 +870,28 @@ func (c *CMSketch) queryHashValue(sctx sessionctx.Context, h1, h2 uint64) (resul
 			debugtrace.LeaveContextCommon(sctx)
 		}()
 	}
+	result, useDefaultValue = c.queryHashValueWithBuf(h1, h2, vals, originVals)
+	return result
+}
+
+// queryHashValueWithBuf estimates the count of the value hashed into (h1, h2) with the given buffers whose length is the depth.
+func (c *CMSketch) queryHashValueWithBuf(h1, h2 uint64, vals, originVals []uint32) (result uint64, useDefaultValue bool) {
+	result, empty := c.estimateHashValueWithBuf(h1, h2, vals, originVals)
+	if !empty && c.considerDefVal(result) {
+		return c.defaultValue, true
+	}
+	return result, false
+}
+
+// estimateHashValueWithBuf is the count-mean-min estimation of queryHashValueWithBuf without falling back to the default value,
+// empty is true if the value is not hashed into the most rows, in which case the default value is not used either.
+func (c *CMSketch) estimateHashValueWithBuf(h1, h2 uint64, vals, originVals []uint32) (result uint64, empty bool) {
+	min := uint32(math.MaxUint32)
 	// We want that when res is 0 before the noise is eliminated, the default value is not used.
 	// So we need a temp value to distinguish before and after eliminating noise.
 	temp := uint32(1)
 	for i := range c.table {
-		j := (h1 + h2*uint64(i)) % uint64(c.width)
+		j := cellIndex(h1, h2, i, c.width)
 		originVals[i] = c.table[i][j]
 		if min > c.table[i][j] {
 			min = c.table[i][j]
@@ -327,14 +911,115 @@ func (c *CMSketch) queryHashValue(sctx sessionctx.Context, h1, h2 uint64) (resul
 		res = min + temp
 	}
 	if res == 0 {
-		return uint64(0)
+		return 0, true
+	}
+	return uint64(res - temp), false
+}
+
+// HeavyHitters returns the values whose counts exceed `threshold` in the descending order of the counts, and the
+// residual count not covered by them. Since the CMSketch can not enumerate the values, only the TopN values are
+// returned, and the count of the CMSketch, i.e. the rows not in the TopN, is counted as the residual together with
+// the TopN values below the threshold. If the residual is larger than the threshold, there may be heavy hitters
+// hidden in the CMSketch.
+func HeavyHitters(cms *CMSketch, topN *TopN, threshold uint64) (hitters []TopNMeta, residual uint64) {
+	residual = cms.TotalCount()
+	if topN == nil {
+		return nil, residual
+	}
+	for _, meta := range topN.TopN {
+		if meta.Count > threshold {
+			hitters = append(hitters, meta)
+			continue
+		}
+		residual += meta.Count
+	}
+	return SortTopnMeta(hitters), residual
+}
+
+// CorrelationEstimate returns a rough correlation between the frequency distributions of two columns over the shared
+// `joinKeys`. It is the cosine similarity of the estimated frequencies normalized by `totalA` and `totalB`, so it is in
+// [0, 1], 1 means the distributions are identical and 0 means they are disjoint. It is only a heuristic since
+// the estimations of the CMSketch are not accurate, and it returns 0 if it can not be calculated.
+func CorrelationEstimate(a, b *CMSketch, joinKeys [][]byte, totalA, totalB uint64) float64 {
+	if a == nil || b == nil || totalA == 0 || totalB == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for _, key := range joinKeys {
+		fa := float64(a.QueryBytes(key)) / float64(totalA)
+		fb := float64(b.QueryBytes(key)) / float64(totalB)
+		dot += fa * fb
+		normA += fa * fa
+		normB += fb * fb
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// DistributionDivergence returns the Jensen-Shannon divergence between the estimated frequency distributions of two
+// CMSketches over the candidate `keys`, e.g. to detect the drift of the statistics. The estimations are normalized by
+// their sums over the keys, and the divergence is calculated with log base 2, so it is in [0, 1]: 0 means the
+// distributions are identical and 1 means they are disjoint. Unlike the KL divergence, it is symmetric and finite
+// even if a key only appears in one of them. It returns 0 if both are empty and 1 if only one of them is empty.
+func DistributionDivergence(a, b *CMSketch, keys [][]byte) float64 {
+	var estimatesA, estimatesB []uint64
+	var sumA, sumB float64
+	if a != nil {
+		estimatesA = a.QueryValues(keys)
+		for _, estimate := range estimatesA {
+			sumA += float64(estimate)
+		}
+	}
+	if b != nil {
+		estimatesB = b.QueryValues(keys)
+		for _, estimate := range estimatesB {
+			sumB += float64(estimate)
+		}
+	}
+	if sumA == 0 || sumB == 0 {
+		if sumA == sumB {
+			return 0
+		}
+		return 1
+	}
+	// klTerm is the term of the KL divergence from `p` to the mixture `m`, `p * log2(p / m)`, which is 0 if `p` is 0.
+	klTerm := func(p, m float64) float64 {
+		if p == 0 {
+			return 0
+		}
+		return p * math.Log2(p/m)
+	}
+	divergence := 0.0
+	for i := range keys {
+		p, q := float64(estimatesA[i])/sumA, float64(estimatesB[i])/sumB
+		m := (p + q) / 2
+		divergence += (klTerm(p, m) + klTerm(q, m)) / 2
+	}
+	// Clamp the rounding errors.
+	return math.Max(0, math.Min(1, divergence))
+}
+
+// MassSymmetricDifference returns the sum of `|estA(k) - estB(k)|` over the candidate `keys`, which measures the
+// drift between two CMSketches, e.g. the ones built by two analyze runs. The dimensions of them should be the same.
+func MassSymmetricDifference(a, b *CMSketch, keys [][]byte) (uint64, error) {
+	if a == nil || b == nil {
+		return 0, errors.New("Count-Min Sketch should not be nil")
 	}
-	res = res - temp
-	if c.considerDefVal(uint64(res)) {
-		useDefaultValue = true
-		return c.defaultValue
+	if a.depth != b.depth || a.width != b.width {
+		return 0, errors.New("Dimensions of Count-Min Sketch should be the same")
+	}
+	estA, estB := a.QueryValues(keys), b.QueryValues(keys)
+	diff := uint64(0)
+	for i := range keys {
+		if estA[i] > estB[i] {
+			diff += estA[i] - estB[i]
+		} else {
+			diff += estB[i] - estA[i]
+		}
 	}
-	return uint64(res)
+	return diff, nil
 }
 
 // MergeTopNAndUpdateCMSketch merges the src TopN into the dst, and spilled values will be inserted into the CMSketch.
@@ -346,6 +1031,7 @@ func MergeTopNAndUpdateCMSketch(dst, src *TopN, c *CMSketch, numTop uint32) []To
 		return popedTopNPair
 	}
 	dst.TopN = mergedTopN.TopN
+	dst.pinned = mergedTopN.pinned
 	for _, topNMeta := range popedTopNPair {
 		c.InsertBytesByCount(topNMeta.Encoded, topNMeta.Count)
 	}
@@ -369,33 +1055,192 @@ func (c *CMSketch) MergeCMSketch(rc *CMSketch) error {
 	return nil
 }
 
-// MergeCMSketch4IncrementalAnalyze merges two CM Sketch for incremental analyze. Since there is no value
-// that appears partially in `c` and `rc` for incremental analyze, it uses `max` to merge them.
-// Here is a simple proof: when we query from the CM sketch, we use the `min` to get the answer:
-//
-//	(1): For values that only appears in `c, using `max` to merge them affects the `min` query result less than using `sum`;
-//	(2): For values that only appears in `rc`, it is the same as condition (1);
-//	(3): For values that appears both in `c` and `rc`, if they do not appear partially in `c` and `rc`, for example,
-//	     if `v` appears 5 times in the table, it can appears 5 times in `c` and 3 times in `rc`, then `max` also gives the correct answer.
-//
-// So in fact, if we can know the number of appearances of each value in the first place, it is better to use `max` to construct the CM sketch rather than `sum`.
-func (c *CMSketch) MergeCMSketch4IncrementalAnalyze(rc *CMSketch, _ uint32) error {
+// MergeMax merges `rc` into the CMSketch by taking the maximum of every counter instead of the sum, and the count
+// is the maximum of the two counts. It estimates the union rather than the total occurrences, e.g. the coverage of
+// the distinct keys across the partitions.
+func (c *CMSketch) MergeMax(rc *CMSketch) error {
+	if c == nil || rc == nil {
+		return nil
+	}
 	if c.depth != rc.depth || c.width != rc.width {
 		return errors.New("Dimensions of Count-Min Sketch should be the same")
 	}
+	c.count = mathutil.Max(c.count, rc.count)
 	for i := range c.table {
-		c.count = 0
 		for j := range c.table[i] {
 			c.table[i][j] = mathutil.Max(c.table[i][j], rc.table[i][j])
-			c.count += uint64(c.table[i][j])
 		}
 	}
 	return nil
 }
 
-// CMSketchToProto converts CMSketch to its protobuf representation.
-func CMSketchToProto(c *CMSketch, topn *TopN) *tipb.CMSketch {
-	protoSketch := &tipb.CMSketch{}
+// MergeSparse merges `rc` into the CMSketch like MergeCMSketch, but only the non-zero counters of `rc` are added,
+// so the counters of the CMSketch are not touched for the zero ones. It is faster than MergeCMSketch if most
+// counters of `rc` are zero, e.g. the CMSketch of a small partition.
+func (c *CMSketch) MergeSparse(rc *CMSketch) error {
+	if c == nil || rc == nil {
+		return nil
+	}
+	if c.depth != rc.depth || c.width != rc.width {
+		return errors.New("Dimensions of Count-Min Sketch should be the same")
+	}
+	c.count += rc.count
+	for i := range rc.table {
+		for j, counter := range rc.table[i] {
+			if counter != 0 {
+				c.table[i][j] += counter
+			}
+		}
+	}
+	return nil
+}
+
+// SubCMSketch subtracts `rc` from the CMSketch, e.g. the CMSketch of the deleted rows, the counters and the count
+// saturate at zero. Like SubBytes, the estimations are not the upper bounds any more after the subtraction.
+func (c *CMSketch) SubCMSketch(rc *CMSketch) error {
+	if c == nil || rc == nil {
+		return nil
+	}
+	if c.depth != rc.depth || c.width != rc.width {
+		return errors.New("Dimensions of Count-Min Sketch should be the same")
+	}
+	c.count = saturatingSub(c.count, rc.count)
+	for i := range c.table {
+		for j := range c.table[i] {
+			c.table[i][j] = uint32(saturatingSub(uint64(c.table[i][j]), uint64(rc.table[i][j])))
+		}
+	}
+	return nil
+}
+
+// Decay multiplies all the counters, the count and the default value by `factor` in (0, 1], rounding down, so the
+// old inserts fade out. Decaying periodically before inserting the new values makes the CMSketch an exponentially
+// weighted sliding window, in which an insert is weighted by factor^k after k decays.
+func (c *CMSketch) Decay(factor float64) error {
+	if c == nil {
+		return nil
+	}
+	if !(factor > 0 && factor <= 1) {
+		return errors.Errorf("the decay factor %v should be in (0, 1]", factor)
+	}
+	c.count = uint64(float64(c.count) * factor)
+	c.defaultValue = uint64(float64(c.defaultValue) * factor)
+	for i := range c.table {
+		for j := range c.table[i] {
+			c.table[i][j] = uint32(float64(c.table[i][j]) * factor)
+		}
+	}
+	return nil
+}
+
+// RescaleWidth returns a copy of the CMSketch folded to `newWidth`, which should divide the width. Since a value is
+// counted in the column `(h1 + h2*i) % width`, it is in the column `(h1 + h2*i) % newWidth` after summing up the
+// columns with the same remainder, so the folded sketch is the same as the one built with `newWidth` directly.
+func (c *CMSketch) RescaleWidth(newWidth int32) (*CMSketch, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if newWidth <= 0 || c.width%newWidth != 0 {
+		return nil, errors.Errorf("the new width %d should be positive and divide the width %d", newWidth, c.width)
+	}
+	rescaled := NewCMSketch(c.depth, newWidth)
+	for i := range c.table {
+		for j, counter := range c.table[i] {
+			rescaled.table[i][int32(j)%newWidth] += counter
+		}
+	}
+	rescaled.count = c.count
+	rescaled.defaultValue = c.defaultValue
+	return rescaled, nil
+}
+
+// MergeInto merges `rc` into the CMSketch like MergeCMSketch, but `rc` may be wider than the CMSketch, in which case
+// it is folded to the width of the CMSketch by RescaleWidth first. The width of `rc` should be a multiple of it.
+func (c *CMSketch) MergeInto(rc *CMSketch) error {
+	if c == nil || rc == nil {
+		return nil
+	}
+	if rc.width != c.width {
+		var err error
+		rc, err = rc.RescaleWidth(c.width)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return c.MergeCMSketch(rc)
+}
+
+// MergeCMSketchWithRescale merges `rc` into the CMSketch like MergeInto, but either of them may be the wider one, e.g.
+// the partition-level sketches analyzed before and after changing the width. The wider one is folded to the narrower
+// width by RescaleWidth, so its width should be a multiple of the narrower one, and the depths should be the same.
+// Unlike MergeCMSketch, the default values are summed up like the counts.
+func (c *CMSketch) MergeCMSketchWithRescale(rc *CMSketch) error {
+	if c == nil || rc == nil {
+		return nil
+	}
+	if c.depth != rc.depth {
+		return errors.Errorf("the depths of Count-Min Sketch should be the same, but got %d and %d", c.depth, rc.depth)
+	}
+	if c.width > rc.width {
+		rescaled, err := c.RescaleWidth(rc.width)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.table, c.width = rescaled.table, rescaled.width
+	}
+	if err := c.MergeInto(rc); err != nil {
+		return errors.Trace(err)
+	}
+	c.defaultValue += rc.defaultValue
+	return nil
+}
+
+// MergeCMSketch4IncrementalAnalyze merges two CM Sketch for incremental analyze. Since there is no value
+// that appears partially in `c` and `rc` for incremental analyze, it uses `max` to merge them.
+// Here is a simple proof: when we query from the CM sketch, we use the `min` to get the answer:
+//
+//	(1): For values that only appears in `c, using `max` to merge them affects the `min` query result less than using `sum`;
+//	(2): For values that only appears in `rc`, it is the same as condition (1);
+//	(3): For values that appears both in `c` and `rc`, if they do not appear partially in `c` and `rc`, for example,
+//	     if `v` appears 5 times in the table, it can appears 5 times in `c` and 3 times in `rc`, then `max` also gives the correct answer.
+//
+// So in fact, if we can know the number of appearances of each value in the first place, it is better to use `max` to construct the CM sketch rather than `sum`.
+func (c *CMSketch) MergeCMSketch4IncrementalAnalyze(rc *CMSketch, _ uint32) error {
+	if c.depth != rc.depth || c.width != rc.width {
+		return errors.New("Dimensions of Count-Min Sketch should be the same")
+	}
+	for i := range c.table {
+		c.count = 0
+		for j := range c.table[i] {
+			c.table[i][j] = mathutil.Max(c.table[i][j], rc.table[i][j])
+			c.count += uint64(c.table[i][j])
+		}
+	}
+	return nil
+}
+
+// MergeCMSketchAndTopN4IncrementalAnalyze merges `rc` into the CMSketch like MergeCMSketch4IncrementalAnalyze, and
+// merges `rTopN` into `topN` keeping at most `numTop` values like MergeTopNAndUpdateCMSketch. The values demoted from
+// the TopN are inserted into the merged CMSketch, and they are returned like the leftTopN of MergePartTopN2GlobalTopN,
+// so the callers can account for the demoted rows, e.g. adding them to the histogram. The droppedMass is the total
+// count of the demoted values, so the count of the merged TopN plus droppedMass is the count of the two TopNs.
+func (c *CMSketch) MergeCMSketchAndTopN4IncrementalAnalyze(rc *CMSketch, topN, rTopN *TopN, numTop uint32) (demoted []TopNMeta, droppedMass uint64, err error) {
+	if err := c.MergeCMSketch4IncrementalAnalyze(rc, numTop); err != nil {
+		return nil, 0, err
+	}
+	if topN == nil {
+		return nil, 0, nil
+	}
+	demoted = MergeTopNAndUpdateCMSketch(topN, rTopN, c, numTop)
+	for _, meta := range demoted {
+		droppedMass += meta.Count
+	}
+	return demoted, droppedMass, nil
+}
+
+// CMSketchToProto converts CMSketch to its protobuf representation.
+func CMSketchToProto(c *CMSketch, topn *TopN) *tipb.CMSketch {
+	protoSketch := &tipb.CMSketch{}
 	if c != nil {
 		protoSketch.Rows = make([]*tipb.CMSketchRow, c.depth)
 		for i := range c.table {
@@ -448,8 +1293,23 @@ func TopNFromProto(protoTopN []*tipb.CMSketchTopN) *TopN {
 	return topN
 }
 
+const (
+	// cmSketchEncodingVersion is the version of the protobuf data prefixed by a version byte. EncodeCMSketchWithoutTopN
+	// writes the protobuf data without the version byte as the version 0, which the old versions can decode, so this
+	// version is only decoded.
+	cmSketchEncodingVersion = 1
+	// cmSketchEncodingVersionRLE is the version of the run-length encoding of EncodeCMSketchCompressed.
+	cmSketchEncodingVersionRLE = 2
+	// maxCMSketchEncodingVersion is the largest version which can be distinguished from the unversioned data.
+	// The first byte of a protobuf message is the tag of a field, whose field number is never 0, so the byte is at
+	// least 0x08, and a smaller first byte must be a version.
+	maxCMSketchEncodingVersion = 0x07
+)
+
 // EncodeCMSketchWithoutTopN encodes the given CMSketch to byte slice.
 // Note that it does not include the topN.
+// The protobuf data is written without the version byte, so the nodes of the old versions can still decode it, e.g.
+// during the rolling upgrade.
 func EncodeCMSketchWithoutTopN(c *CMSketch) ([]byte, error) {
 	if c == nil {
 		return nil, nil
@@ -460,62 +1320,707 @@ func EncodeCMSketchWithoutTopN(c *CMSketch) ([]byte, error) {
 	return protoData, err
 }
 
+// EncodeCMSketchCompressed encodes the given CMSketch like EncodeCMSketchWithoutTopN, but every row is run-length
+// encoded as the pairs of the number of the zero counters and the following non-zero counter, which is much smaller
+// for the sparse CMSketch, e.g. the one of a column with few distinct values. If the run-length encoding doesn't
+// help, e.g. for the saturated CMSketch, the result of EncodeCMSketchWithoutTopN is returned. Both of them are decoded
+// by DecodeCMSketchAndTopN.
+func EncodeCMSketchCompressed(c *CMSketch) ([]byte, error) {
+	if c == nil {
+		return nil, nil
+	}
+	plain, err := EncodeCMSketchWithoutTopN(c)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{cmSketchEncodingVersionRLE}
+	data = binary.AppendUvarint(data, uint64(c.depth))
+	data = binary.AppendUvarint(data, uint64(c.width))
+	data = binary.AppendUvarint(data, c.defaultValue)
+	for i := range c.table {
+		zeros := uint64(0)
+		for _, counter := range c.table[i] {
+			if counter == 0 {
+				zeros++
+				continue
+			}
+			data = binary.AppendUvarint(data, zeros)
+			data = binary.AppendUvarint(data, uint64(counter))
+			zeros = 0
+			if len(data) >= len(plain) {
+				return plain, nil
+			}
+		}
+		// The trailing zero counters end the row.
+		data = binary.AppendUvarint(data, zeros)
+		data = binary.AppendUvarint(data, 0)
+	}
+	if len(data) >= len(plain) {
+		return plain, nil
+	}
+	return data, nil
+}
+
+// maxDecodedCMSketchSize bounds the number of the counters of the run-length encoded CMSketch, i.e. depth * width,
+// whose rows of zero counters take only a few bytes. The analyze limits depth * width much lower by the size limit
+// of the transaction entry, the bound is looser so that the CMSketch analyzed with a larger limit still decodes.
+const maxDecodedCMSketchSize = 1 << 25
+
+// decodeCMSketchRLE decodes the rows of the CMSketch encoded by EncodeCMSketchCompressed without the version byte.
+func decodeCMSketchRLE(data []byte) (*tipb.CMSketch, error) {
+	errInvalid := errors.New("invalid run-length encoded Count-Min Sketch data")
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errInvalid
+		}
+		data = data[n:]
+		return v, nil
+	}
+	depth, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	width, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	// The dimensions are checked before allocating the rows, so the corrupted data can't cause a huge allocation.
+	if depth > maxDecodedCMSketchSize || width > maxDecodedCMSketchSize || depth*width > maxDecodedCMSketchSize {
+		return nil, errors.Errorf("the dimensions (%d, %d) of the run-length encoded Count-Min Sketch exceed the limit %d",
+			depth, width, maxDecodedCMSketchSize)
+	}
+	p := &tipb.CMSketch{}
+	if p.DefaultValue, err = readUvarint(); err != nil {
+		return nil, err
+	}
+	// Each row takes at least 2 bytes for the trailing zero counters and the end mark.
+	if 2*depth > uint64(len(data)) {
+		return nil, errInvalid
+	}
+	p.Rows = make([]*tipb.CMSketchRow, depth)
+	for i := range p.Rows {
+		p.Rows[i] = &tipb.CMSketchRow{Counters: make([]uint32, width)}
+		for j := uint64(0); ; j++ {
+			zeros, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			counter, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			j += zeros
+			if counter == 0 {
+				if j != width {
+					return nil, errInvalid
+				}
+				break
+			}
+			if j >= width || counter > math.MaxUint32 {
+				return nil, errInvalid
+			}
+			p.Rows[i].Counters[j] = uint32(counter)
+		}
+	}
+	if len(data) != 0 {
+		return nil, errInvalid
+	}
+	return p, nil
+}
+
+// unmarshalCMSketch decodes the protobuf representation of the CMSketch encoded by EncodeCMSketchWithoutTopN or
+// EncodeCMSketchCompressed by the version byte. The data without the version byte is encoded by the old versions as
+// the version 0, so the stored statistics still decode.
+func unmarshalCMSketch(data []byte) (*tipb.CMSketch, error) {
+	if len(data) > 0 && data[0] <= maxCMSketchEncodingVersion {
+		switch data[0] {
+		case cmSketchEncodingVersion:
+			data = data[1:]
+		case cmSketchEncodingVersionRLE:
+			return decodeCMSketchRLE(data[1:])
+		default:
+			return nil, errors.Errorf("unsupported encoding version %d of Count-Min Sketch, the latest supported version is %d",
+				data[0], cmSketchEncodingVersionRLE)
+		}
+	}
+	p := &tipb.CMSketch{}
+	if err := p.Unmarshal(data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p, nil
+}
+
+// MergeEncodedCMSketches merges the CMSketches encoded by EncodeCMSketchWithoutTopN, e.g. the partition-level ones, and
+// returns the encoded result. The sketches are decoded and merged one by one, so only two of them are in memory at
+// the same time. The empty ones are skipped, and the dimensions of the others should be the same.
+func MergeEncodedCMSketches(encoded [][]byte) ([]byte, error) {
+	var merged *CMSketch
+	for i, data := range encoded {
+		c, _, err := DecodeCMSketchAndTopN(data, nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if c == nil {
+			continue
+		}
+		if merged == nil {
+			merged = c
+			continue
+		}
+		if merged.depth != c.depth || merged.width != c.width {
+			return nil, errors.Errorf("the dimensions of the %d-th Count-Min Sketch (%d, %d) are different from (%d, %d)",
+				i, c.depth, c.width, merged.depth, merged.width)
+		}
+		if err := merged.MergeCMSketch(c); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return EncodeCMSketchWithoutTopN(merged)
+}
+
+// EncodeRows encodes the first `rows` rows of the given CMSketch to byte slice, the TopN is not included.
+// Every row of the CMSketch is an independent estimation, so the sketch decoded by DecodeCMSketchRows
+// still gives conservative estimations, but with a lower confidence.
+func (c *CMSketch) EncodeRows(rows int) ([]byte, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if rows <= 0 || rows > int(c.depth) {
+		return nil, errors.Errorf("the number of rows to encode should be in [1, %d], but got %d", c.depth, rows)
+	}
+	p := CMSketchToProto(c, nil)
+	p.Rows = p.Rows[:rows]
+	protoData, err := p.Marshal()
+	return protoData, err
+}
+
+// DecodeCMSketchRows decodes a CMSketch encoded by EncodeRows, the depth of the result is the number of encoded rows.
+func DecodeCMSketchRows(data []byte) (*CMSketch, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	p := &tipb.CMSketch{}
+	err := p.Unmarshal(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cm, _ := CMSketchAndTopNFromProto(p)
+	return cm, nil
+}
+
 // DecodeCMSketchAndTopN decode a CMSketch from the given byte slice.
 func DecodeCMSketchAndTopN(data []byte, topNRows []chunk.Row) (*CMSketch, *TopN, error) {
+	return DecodeCMSketchAndTopNWithMinCount(data, topNRows, 0)
+}
+
+// DecodeCMSketchAndTopNWithMinCount decodes a CMSketch from the given byte slice like DecodeCMSketchAndTopN, but the
+// TopN rows whose counts are less than `minCount` are skipped. The skipped values are inserted into the CMSketch, so
+// their counts are still estimated by the CMSketch rather than lost, unless there is no CMSketch, e.g. for the stats
+// version 2, in which case they are dropped.
+func DecodeCMSketchAndTopNWithMinCount(data []byte, topNRows []chunk.Row, minCount uint64) (*CMSketch, *TopN, error) {
 	if data == nil && len(topNRows) == 0 {
 		return nil, nil, nil
 	}
 	pbTopN := make([]*tipb.CMSketchTopN, 0, len(topNRows))
+	var skipped []*tipb.CMSketchTopN
 	for _, row := range topNRows {
 		data := make([]byte, len(row.GetBytes(0)))
 		copy(data, row.GetBytes(0))
-		pbTopN = append(pbTopN, &tipb.CMSketchTopN{
+		meta := &tipb.CMSketchTopN{
 			Data:  data,
 			Count: row.GetUint64(1),
-		})
+		}
+		if meta.Count < minCount {
+			skipped = append(skipped, meta)
+			continue
+		}
+		pbTopN = append(pbTopN, meta)
 	}
 	if len(data) == 0 {
 		return nil, TopNFromProto(pbTopN), nil
 	}
-	p := &tipb.CMSketch{}
-	err := p.Unmarshal(data)
+	p, err := unmarshalCMSketch(data)
 	if err != nil {
-		return nil, nil, errors.Trace(err)
+		return nil, nil, err
 	}
 	p.TopN = pbTopN
 	cm, topN := CMSketchAndTopNFromProto(p)
+	if cm != nil {
+		for _, meta := range skipped {
+			cm.InsertBytesByCount(meta.Data, meta.Count)
+		}
+	}
 	return cm, topN, nil
 }
 
-// TotalCount returns the total count in the sketch, it is only used for test.
-func (c *CMSketch) TotalCount() uint64 {
+// cmSketchJSON is the JSON form of the CMSketch, which is only used to inspect the stats for debugging, the stats
+// are stored in the protobuf encoding.
+type cmSketchJSON struct {
+	Depth        int32      `json:"depth"`
+	Width        int32      `json:"width"`
+	Count        uint64     `json:"count"`
+	DefaultValue uint64     `json:"default_value"`
+	Table        [][]uint32 `json:"table"`
+}
+
+// MarshalJSON implements the json.Marshaler interface, the counters are emitted as a 2D array row by row.
+func (c *CMSketch) MarshalJSON() ([]byte, error) {
+	if c == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(&cmSketchJSON{
+		Depth:        c.depth,
+		Width:        c.width,
+		Count:        c.count,
+		DefaultValue: c.defaultValue,
+		Table:        c.table,
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (c *CMSketch) UnmarshalJSON(data []byte) error {
+	var j cmSketchJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return errors.Trace(err)
+	}
+	restored, err := RestoreCMSketch(j.Depth, j.Width, j.Count, j.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	restored.defaultValue = j.DefaultValue
+	*c = *restored
+	return nil
+}
+
+// topNMetaJSON is the JSON form of the TopNMeta, the encoded value is hex-encoded.
+type topNMetaJSON struct {
+	Encoded string `json:"encoded"`
+	Count   uint64 `json:"count"`
+}
+
+// MarshalJSON implements the json.Marshaler interface, it's only used to inspect the TopN for debugging.
+func (c *TopN) MarshalJSON() ([]byte, error) {
+	metas := make([]topNMetaJSON, 0, c.Num())
+	if c != nil {
+		for _, meta := range c.TopN {
+			metas = append(metas, topNMetaJSON{Encoded: hex.EncodeToString(meta.Encoded), Count: meta.Count})
+		}
+	}
+	return json.Marshal(metas)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (c *TopN) UnmarshalJSON(data []byte) error {
+	var metas []topNMetaJSON
+	if err := json.Unmarshal(data, &metas); err != nil {
+		return errors.Trace(err)
+	}
+	c.TopN = make([]TopNMeta, 0, len(metas))
+	for _, meta := range metas {
+		encoded, err := hex.DecodeString(meta.Encoded)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		c.TopN = append(c.TopN, TopNMeta{Encoded: encoded, Count: meta.Count})
+	}
+	return nil
+}
+
+// EncodeTopNCompressed encodes the TopN with the front coding, the encoded values of the sorted TopN
+// usually share common prefixes, e.g. the composite index keys sharing the leading columns, so only
+// the length of the prefix shared with the previous value and the remaining suffix are stored.
+func EncodeTopNCompressed(topN *TopN) []byte {
+	if topN.Num() == 0 {
+		return nil
+	}
+	data := binary.AppendUvarint(nil, uint64(len(topN.TopN)))
+	var prev []byte
+	for _, meta := range topN.TopN {
+		shared := 0
+		for shared < len(prev) && shared < len(meta.Encoded) && prev[shared] == meta.Encoded[shared] {
+			shared++
+		}
+		data = binary.AppendUvarint(data, uint64(shared))
+		data = binary.AppendUvarint(data, uint64(len(meta.Encoded)-shared))
+		data = append(data, meta.Encoded[shared:]...)
+		data = binary.AppendUvarint(data, meta.Count)
+		prev = meta.Encoded
+	}
+	return data
+}
+
+// DecodeTopNCompressed decodes the TopN encoded by EncodeTopNCompressed.
+func DecodeTopNCompressed(data []byte) (*TopN, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errors.New("invalid compressed TopN data")
+		}
+		data = data[n:]
+		return v, nil
+	}
+	num, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	topN := NewTopN(int(mathutil.Min(num, uint64(len(data)))))
+	var prev []byte
+	for i := uint64(0); i < num; i++ {
+		shared, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		suffixLen, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if shared > uint64(len(prev)) || suffixLen > uint64(len(data)) {
+			return nil, errors.New("invalid compressed TopN data")
+		}
+		encoded := make([]byte, 0, shared+suffixLen)
+		encoded = append(encoded, prev[:shared]...)
+		encoded = append(encoded, data[:suffixLen]...)
+		data = data[suffixLen:]
+		count, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		topN.AppendTopN(encoded, count)
+		prev = encoded
+	}
+	if len(data) != 0 {
+		return nil, errors.New("invalid compressed TopN data")
+	}
+	return topN, nil
+}
+
+// TotalCount returns the total count of the values in the sketch.
+func (c *CMSketch) TotalCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.count
+}
+
+// ApproxKeyCount estimates how many distinct keys have been inserted into the CMSketch by linear counting:
+// if there are `z` zero counters in a row of width `w`, about `-w * ln(z / w)` distinct keys are hashed into it.
+// The median of the estimations of all rows is returned. Unlike the count, which is the number of the inserted
+// rows, it is not affected by the duplicated keys, but it is inaccurate when the most counters are not zero.
+func (c *CMSketch) ApproxKeyCount() int64 {
+	if c == nil || len(c.table) == 0 {
+		return 0
+	}
+	estimates := make([]float64, 0, len(c.table))
+	w := float64(c.width)
+	for i := range c.table {
+		zeros := 0
+		for _, counter := range c.table[i] {
+			if counter == 0 {
+				zeros++
+			}
+		}
+		if zeros == 0 {
+			// The row is saturated, w * ln(w) is the expected number of keys to fill all the counters.
+			estimates = append(estimates, w*math.Log(w))
+			continue
+		}
+		estimates = append(estimates, -w*math.Log(float64(zeros)/w))
+	}
+	slices.Sort(estimates)
+	estimate := int64(math.Round(estimates[len(estimates)/2]))
+	return mathutil.Min(estimate, int64(c.count))
+}
+
+// MaxEstimate returns an upper bound of the count of the heaviest single value, it is used for the quick skew detection.
+// The counter of a value in every row is not less than its count, so the maximum counter of any row bounds the count
+// of the heaviest value, and the least one among the rows is returned. Use the TopN instead if it is available.
+func (c *CMSketch) MaxEstimate() uint64 {
+	if c == nil || len(c.table) == 0 {
+		return 0
+	}
+	result := uint32(math.MaxUint32)
+	for i := range c.table {
+		rowMax := uint32(0)
+		for _, counter := range c.table[i] {
+			rowMax = mathutil.Max(rowMax, counter)
+		}
+		result = mathutil.Min(result, rowMax)
+	}
+	return uint64(result)
+}
+
+// SaturatedCounters returns the number of the counters which are math.MaxUint32 and the fraction of them in all the
+// d*w counters. The estimations on the saturated counters are meaningless, so a larger width should be used to
+// rebuild the CMSketch if the fraction is high.
+func (c *CMSketch) SaturatedCounters() (count int, fraction float64) {
+	if c == nil || len(c.table) == 0 {
+		return 0, 0
+	}
+	for i := range c.table {
+		for _, counter := range c.table[i] {
+			if counter == math.MaxUint32 {
+				count++
+			}
+		}
+	}
+	return count, float64(count) / float64(int(c.depth)*int(c.width))
+}
+
+// ImpliedCount returns the median of the row sums of the CMSketch. Every row sums up all the inserted counts,
+// so it should be equal to the count unless the CMSketch is corrupted.
+func (c *CMSketch) ImpliedCount() uint64 {
+	if c == nil || len(c.table) == 0 {
+		return 0
+	}
+	sums := make([]uint64, len(c.table))
+	for i := range c.table {
+		for _, counter := range c.table[i] {
+			sums[i] += uint64(counter)
+		}
+	}
+	slices.Sort(sums)
+	return sums[len(sums)/2]
+}
+
+// SetCell sets the counter in the `row`-th row and the `col`-th column, e.g. to build a specific CMSketch for the tests
+// and the tuning tools. The count is not changed, call RepairCount to recompute it from the counters after setting.
+func (c *CMSketch) SetCell(row, col int32, value uint32) error {
+	if row < 0 || row >= c.depth || col < 0 || col >= c.width {
+		return errors.Errorf("the cell (%d, %d) is out of the CMSketch of depth %d and width %d", row, col, c.depth, c.width)
+	}
+	c.table[row][col] = value
+	return nil
+}
+
+// RepairCount sets the count to the ImpliedCount. It is a best-effort correction for the CMSketch whose count
+// is corrupted, e.g. by decoding the broken data, since the corrupted rows can not be recovered.
+func (c *CMSketch) RepairCount() {
+	if c == nil {
+		return
+	}
+	c.count = c.ImpliedCount()
+}
+
+// ApplyLaplaceNoise adds the Laplace noise to every counter for sharing the CMSketch externally, the counters are
+// rounded and clamped to [0, math.MaxUint32]. Inserting a row changes one counter in each row, so the sensitivity
+// is the depth and the noise scale is `depth/epsilon`, which makes the frequency queries epsilon-differentially
+// private. The smaller epsilon gives the stronger privacy but the larger error, and the error is relatively smaller
+// for the frequent values. The count and the default value are not changed.
+func (c *CMSketch) ApplyLaplaceNoise(epsilon float64, rng *rand.Rand) {
+	if c == nil || epsilon <= 0 {
+		return
+	}
+	scale := float64(c.depth) / epsilon
+	for i := range c.table {
+		for j := range c.table[i] {
+			// The inverse CDF of the Laplace distribution on the uniform value in (-0.5, 0.5).
+			u := rng.Float64() - 0.5
+			if u == -0.5 {
+				u = 0
+			}
+			noise := -scale * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+			counter := math.Round(float64(c.table[i][j]) + noise)
+			c.table[i][j] = uint32(math.Max(0, math.Min(math.MaxUint32, counter)))
+		}
+	}
+}
+
+// CompactDepth returns a copy of the CMSketch compacted to `newDepth` rows, `newDepth` should divide the depth.
+// The rows are grouped as {k, k+newDepth, k+2*newDepth, ...} and every group is compacted into the row `k`.
+// Note that the element-wise min of the rows in a group can not be used: the row `i` hashes a key with the
+// seed `i`, so the counters at the same column of the other rows may count none of the key, and the min may
+// underestimate it. Only the row `k` is hashed with the seed `k`, so it is kept and the estimations of the
+// result are still upper bounds of the true counts, with a lower confidence.
+func (c *CMSketch) CompactDepth(newDepth int32) (*CMSketch, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if newDepth <= 0 || newDepth > c.depth || c.depth%newDepth != 0 {
+		return nil, errors.Errorf("the new depth %d should be positive and divide the depth %d", newDepth, c.depth)
+	}
+	compacted := NewCMSketch(newDepth, c.width)
+	for k := range compacted.table {
+		copy(compacted.table[k], c.table[k])
+	}
+	compacted.count = c.count
+	compacted.defaultValue = c.defaultValue
+	return compacted, nil
+}
+
+// Equal tests if two CM Sketch equal, it is only used for test.
+func (c *CMSketch) Equal(rc *CMSketch) bool {
+	return reflect.DeepEqual(c, rc)
+}
+
+// ApproxEqual checks if the CMSketch has the same depth and width as rc and every counter differs from the one of rc
+// by at most maxCounterDelta, e.g. to compare the results of the approximate merging and rescaling. The count and the
+// default value are not compared.
+func (c *CMSketch) ApproxEqual(rc *CMSketch, maxCounterDelta uint32) bool {
+	if c == nil || rc == nil {
+		return c == nil && rc == nil
+	}
+	if c.depth != rc.depth || c.width != rc.width {
+		return false
+	}
+	for i := range c.table {
+		for j, counter := range c.table[i] {
+			if mathutil.Max(counter, rc.table[i][j])-mathutil.Min(counter, rc.table[i][j]) > maxCounterDelta {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Copy makes a copy for current CMSketch.
+func (c *CMSketch) Copy() *CMSketch {
+	if c == nil {
+		return nil
+	}
+	tbl := make([][]uint32, c.depth)
+	for i := range tbl {
+		tbl[i] = make([]uint32, c.width)
+		copy(tbl[i], c.table[i])
+	}
+	return &CMSketch{count: c.count, width: c.width, depth: c.depth, table: tbl, defaultValue: c.defaultValue}
+}
+
+// Reset clears the CMSketch in place, so it is the same as a new CMSketch with the same depth and width and its
+// table can be reused, e.g. to build the CMSketches of the partitions one by one.
+func (c *CMSketch) Reset() {
+	if c == nil {
+		return
+	}
+	for i := range c.table {
+		row := c.table[i]
+		for j := range row {
+			row[j] = 0
+		}
+	}
+	c.count = 0
+	c.defaultValue = 0
+}
+
+// TableView returns the counters of the CMSketch row by row for the storage layers persisting them directly.
+// The rows alias the internal table, so they are read-only and are changed by the following updates.
+func (c *CMSketch) TableView() [][]uint32 {
+	if c == nil {
+		return nil
+	}
+	return c.table
+}
+
+// RestoreCMSketch rebuilds the CMSketch from the count and the counters returned by TableView, which are copied.
+func RestoreCMSketch(d, w int32, count uint64, table [][]uint32) (*CMSketch, error) {
+	if d <= 0 || w <= 0 {
+		return nil, errors.Errorf("the dimensions of Count-Min Sketch should be positive, but got (%d, %d)", d, w)
+	}
+	if len(table) != int(d) {
+		return nil, errors.Errorf("the Count-Min Sketch should have %d rows, but got %d", d, len(table))
+	}
+	c := NewCMSketch(d, w)
+	for i, row := range table {
+		if len(row) != int(w) {
+			return nil, errors.Errorf("the row %d of Count-Min Sketch should have %d counters, but got %d", i, w, len(row))
+		}
+		copy(c.table[i], row)
+	}
+	c.count = count
+	return c, nil
+}
+
+// ResidualCount returns the count of the rows represented in the CMSketch, i.e. the rows not covered by the TopN.
+// The TopN values are never inserted into the CMSketch when they are built, so it's the count of the CMSketch.
+func (c *CMSketch) ResidualCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.count
+}
+
+// GetWidthAndDepth returns the width and depth of CM Sketch.
+func (c *CMSketch) GetWidthAndDepth() (width, depth int32) {
+	return c.width, c.depth
+}
+
+// DefaultValue returns the estimate count of the values which are not represented in the CMSketch.
+func (c *CMSketch) DefaultValue() uint64 {
 	if c == nil {
 		return 0
 	}
-	return c.count
+	return c.defaultValue
 }
 
-// Equal tests if two CM Sketch equal, it is only used for test.
-func (c *CMSketch) Equal(rc *CMSketch) bool {
-	return reflect.DeepEqual(c, rc)
+// SetDefaultValue sets the estimate count of the values which are not represented in the CMSketch.
+func (c *CMSketch) SetDefaultValue(v uint64) {
+	if c == nil {
+		return
+	}
+	c.defaultValue = v
 }
 
-// Copy makes a copy for current CMSketch.
-func (c *CMSketch) Copy() *CMSketch {
-	if c == nil {
+// CellInfo describes a counter of the CMSketch.
+type CellInfo struct {
+	Row   int
+	Col   int
+	Count uint32
+}
+
+// HottestCells returns the `k` cells with the highest counts across all rows, ordered by the count descending.
+// The cells which are persistently hot suggest that the width is too small or their values should be added to TopN.
+func (c *CMSketch) HottestCells(k int) []CellInfo {
+	if c == nil || k <= 0 {
 		return nil
 	}
-	tbl := make([][]uint32, c.depth)
-	for i := range tbl {
-		tbl[i] = make([]uint32, c.width)
-		copy(tbl[i], c.table[i])
+	cells := make([]CellInfo, 0, int(c.depth)*int(c.width))
+	for i := range c.table {
+		for j, cnt := range c.table[i] {
+			cells = append(cells, CellInfo{Row: i, Col: j, Count: cnt})
+		}
 	}
-	return &CMSketch{count: c.count, width: c.width, depth: c.depth, table: tbl, defaultValue: c.defaultValue}
+	slices.SortFunc(cells, func(i, j CellInfo) bool {
+		if i.Count != j.Count {
+			return i.Count > j.Count
+		}
+		if i.Row != j.Row {
+			return i.Row < j.Row
+		}
+		return i.Col < j.Col
+	})
+	k = mathutil.Min(k, len(cells))
+	return cells[:k]
 }
 
-// GetWidthAndDepth returns the width and depth of CM Sketch.
-func (c *CMSketch) GetWidthAndDepth() (width, depth int32) {
-	return c.width, c.depth
+// KeyEstimate is a candidate key with its estimated count in the CMSketch.
+type KeyEstimate = struct {
+	Key []byte
+	Est uint64
+}
+
+// ApproxTopK estimates the count of each candidate and returns the `k` candidates with the highest estimates,
+// ordered by the estimate descending. The candidates with the same estimate are ordered by the key ascending,
+// so the result is deterministic. It is a rough replacement of the TopN when no TopN was built.
+func (c *CMSketch) ApproxTopK(candidates [][]byte, k int) []KeyEstimate {
+	if c == nil || k <= 0 || len(candidates) == 0 {
+		return nil
+	}
+	ests := c.QueryValues(candidates)
+	results := make([]KeyEstimate, 0, len(candidates))
+	for i, key := range candidates {
+		results = append(results, KeyEstimate{Key: key, Est: ests[i]})
+	}
+	slices.SortFunc(results, func(i, j KeyEstimate) bool {
+		if i.Est != j.Est {
+			return i.Est > j.Est
+		}
+		return bytes.Compare(i.Key, j.Key) < 0
+	})
+	k = mathutil.Min(k, len(results))
+	return results[:k]
 }
 
 // CalcDefaultValForAnalyze calculate the default value for Analyze.
@@ -527,6 +2032,76 @@ func (c *CMSketch) CalcDefaultValForAnalyze(ndv uint64) {
 // TopN stores most-common values, which is used to estimate point queries.
 type TopN struct {
 	TopN []TopNMeta
+	// pinned records the sticky values which are never evicted by merging and truncating.
+	pinned map[string]struct{}
+}
+
+// Pin marks the value as sticky, so it always remains in the TopN regardless of its count when merging and truncating.
+// The pinned values are transient, they are not persisted by the proto, JSON and compressed encodings, so they should
+// be pinned again after the TopN is decoded, e.g. when the stats are loaded from the storage.
+func (c *TopN) Pin(encoded []byte) {
+	if c == nil {
+		return
+	}
+	if c.pinned == nil {
+		c.pinned = make(map[string]struct{})
+	}
+	c.pinned[string(encoded)] = struct{}{}
+}
+
+// IsPinned checks whether the value is marked as sticky.
+func (c *TopN) IsPinned(encoded []byte) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.pinned[string(encoded)]
+	return ok
+}
+
+// Truncate keeps the `n` values with the highest counts and the pinned values, and returns the evicted values.
+func (c *TopN) Truncate(n int) []TopNMeta {
+	if c == nil || len(c.TopN) <= n {
+		return nil
+	}
+	sorted := SortTopnMeta(c.TopN)
+	kept, evicted := sorted[:0], make([]TopNMeta, 0, len(sorted)-n)
+	for i, meta := range sorted {
+		if i < n || c.IsPinned(meta.Encoded) {
+			kept = append(kept, meta)
+			continue
+		}
+		evicted = append(evicted, meta)
+	}
+	c.TopN = kept
+	c.Sort()
+	return evicted
+}
+
+// keepPinnedTopN moves the values pinned in any of the `topNs` from `left` back to the merged TopN, and pins them in it.
+func keepPinnedTopN(topNs []*TopN, merged *TopN, left []TopNMeta) []TopNMeta {
+	for _, topN := range topNs {
+		if topN == nil {
+			continue
+		}
+		for encoded := range topN.pinned {
+			merged.Pin([]byte(encoded))
+		}
+	}
+	if len(merged.pinned) == 0 {
+		return left
+	}
+	// The merged TopN may share the underlying array with `left`, clip it to avoid overwriting `left` when appending.
+	merged.TopN = slices.Clip(merged.TopN)
+	remained := left[:0]
+	for _, meta := range left {
+		if merged.IsPinned(meta.Encoded) {
+			merged.TopN = append(merged.TopN, meta)
+			continue
+		}
+		remained = append(remained, meta)
+	}
+	merged.Sort()
+	return remained
 }
 
 // AppendTopN appends a topn into the TopN struct.
@@ -537,6 +2112,20 @@ func (c *TopN) AppendTopN(data []byte, count uint64) {
 	c.TopN = append(c.TopN, TopNMeta{data, count})
 }
 
+// UpsertTopN adds the count to the value if it's already in the TopN, otherwise inserts it at the sorted position.
+// Unlike AppendTopN, it never introduces duplicated values, but the TopN should be sorted.
+func (c *TopN) UpsertTopN(data []byte, count uint64) {
+	if c == nil {
+		return
+	}
+	idx, match := c.LowerBound(data)
+	if match {
+		c.TopN[idx].Count += count
+		return
+	}
+	c.TopN = slices.Insert(c.TopN, idx, TopNMeta{data, count})
+}
+
 func (c *TopN) String() string {
 	if c == nil {
 		return "EmptyTopN"
@@ -590,6 +2179,60 @@ func (c *TopN) DecodedString(ctx sessionctx.Context, colTypes []byte) (string, e
 	return builder.String(), nil
 }
 
+// TopValuesForColumn returns the top-k distinct values of the `columnIndex`-th column of the composite keys in the TopN,
+// e.g. for the autocomplete of the column values. The counts of the keys sharing the same column value are summed up,
+// and the values are ordered by the summed counts descending. `tps` are the field types of the key columns. Note that
+// the strings with non-binary collations are encoded as their collation keys, so the collation keys are returned.
+func (c *TopN) TopValuesForColumn(columnIndex, k int, tps []*types.FieldType, loc *time.Location) ([]types.Datum, error) {
+	if columnIndex < 0 || columnIndex >= len(tps) {
+		return nil, errors.Errorf("the column index %d is out of the range of %d columns", columnIndex, len(tps))
+	}
+	if c == nil || k <= 0 {
+		return nil, nil
+	}
+	counts := make(map[string]uint64)
+	for _, meta := range c.TopN {
+		remain := meta.Encoded
+		var err error
+		for i := 0; i < columnIndex; i++ {
+			_, remain, err = codec.CutOne(remain)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		col, _, err := codec.CutOne(remain)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		counts[string(col)] += meta.Count
+	}
+	metas := make([]TopNMeta, 0, len(counts))
+	for col, count := range counts {
+		metas = append(metas, TopNMeta{Encoded: []byte(col), Count: count})
+	}
+	SortTopnMeta(metas)
+	metas = metas[:mathutil.Min(k, len(metas))]
+	tp := tps[columnIndex].GetType()
+	values := make([]types.Datum, 0, len(metas))
+	for _, meta := range metas {
+		var d types.Datum
+		var err error
+		if types.IsTypeTime(tp) {
+			// Handle date time values specially since they are encoded to int and we'll get int values if using DecodeOne.
+			_, d, err = codec.DecodeAsDateTime(meta.Encoded, tp, loc)
+		} else if types.IsTypeFloat(tp) {
+			_, d, err = codec.DecodeAsFloat32(meta.Encoded, tp)
+		} else {
+			_, d, err = codec.DecodeOne(meta.Encoded)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		values = append(values, d)
+	}
+	return values, nil
+}
+
 // Copy makes a copy for current TopN.
 func (c *TopN) Copy() *TopN {
 	if c == nil {
@@ -601,9 +2244,30 @@ func (c *TopN) Copy() *TopN {
 		copy(topN[i].Encoded, t.Encoded)
 		topN[i].Count = t.Count
 	}
+	var pinned map[string]struct{}
+	if len(c.pinned) > 0 {
+		pinned = make(map[string]struct{}, len(c.pinned))
+		for encoded := range c.pinned {
+			pinned[encoded] = struct{}{}
+		}
+	}
 	return &TopN{
-		TopN: topN,
+		TopN:   topN,
+		pinned: pinned,
+	}
+}
+
+// Reset removes all the values and the pinned values of the TopN, the capacity of the TopN slice is kept for reuse.
+func (c *TopN) Reset() {
+	if c == nil {
+		return
+	}
+	for i := range c.TopN {
+		// Release the references to the encoded values.
+		c.TopN[i] = TopNMeta{}
 	}
+	c.TopN = c.TopN[:0]
+	c.pinned = nil
 }
 
 // TopNMeta stores the unit of the TopN.
@@ -704,6 +2368,64 @@ func (c *TopN) Sort() {
 	})
 }
 
+// Normalize sorts the TopN by the encoded value and coalesces the entries with the same encoded value by summing up
+// their counts, e.g. AppendTopN is called with the same value more than once, which would be double counted.
+func (c *TopN) Normalize() {
+	if c == nil || len(c.TopN) == 0 {
+		return
+	}
+	c.Sort()
+	coalesced := c.TopN[:1]
+	for _, meta := range c.TopN[1:] {
+		last := &coalesced[len(coalesced)-1]
+		if bytes.Equal(last.Encoded, meta.Encoded) {
+			last.Count += meta.Count
+			continue
+		}
+		coalesced = append(coalesced, meta)
+	}
+	c.TopN = coalesced
+}
+
+// normalizedTopN returns the TopN itself if it's sorted by the encoded value without duplicated entries, otherwise a
+// normalized copy of it, so the TopN, which may be shared by the stats cache, is never changed.
+func normalizedTopN(c *TopN) *TopN {
+	if c == nil {
+		return nil
+	}
+	normalized := true
+	for i := 1; i < len(c.TopN); i++ {
+		if bytes.Compare(c.TopN[i-1].Encoded, c.TopN[i].Encoded) >= 0 {
+			normalized = false
+			break
+		}
+	}
+	if normalized {
+		return c
+	}
+	copied := &TopN{TopN: slices.Clone(c.TopN), pinned: c.pinned}
+	copied.Normalize()
+	return copied
+}
+
+// IsSortedByCount checks whether the TopN is sorted by the count in descending order, the ties are ordered by
+// the encoded value, which is the order produced by SortByCount and SortTopnMeta.
+func (c *TopN) IsSortedByCount() bool {
+	if c == nil {
+		return true
+	}
+	return slices.IsSortedFunc(c.TopN, lessByCount)
+}
+
+// SortByCount sorts the TopN by the count in descending order. Note that QueryTopN and the other lookups
+// require the TopN to be sorted by the encoded value, so Sort should be called before the TopN is used again.
+func (c *TopN) SortByCount() {
+	if c == nil {
+		return
+	}
+	SortTopnMeta(c.TopN)
+}
+
 // TotalCount returns how many data is stored in TopN.
 func (c *TopN) TotalCount() uint64 {
 	if c == nil {
@@ -716,6 +2438,27 @@ func (c *TopN) TotalCount() uint64 {
 	return total
 }
 
+// Scale multiplies the count of each TopN item by `factor` with rounding, it is used to scale the counts
+// of the TopN built from the sample to the population. The TotalCount changes accordingly.
+func (c *TopN) Scale(factor float64) {
+	if c == nil {
+		return
+	}
+	for i := range c.TopN {
+		c.TopN[i].Count = uint64(math.Round(float64(c.TopN[i].Count) * factor))
+	}
+}
+
+// CoverageRatio returns the fraction of the `totalCount` rows covered by the TopN, which is clamped to [0, 1].
+// A low ratio means the TopN is ineffective, e.g. for the flat distributions, and most rows are estimated by the
+// CMSketch or the histogram.
+func (c *TopN) CoverageRatio(totalCount uint64) float64 {
+	if totalCount == 0 {
+		return 0
+	}
+	return math.Min(1, float64(c.TotalCount())/float64(totalCount))
+}
+
 // Equal checks whether the two TopN are equal.
 func (c *TopN) Equal(cc *TopN) bool {
 	if c.TotalCount() == 0 && cc.TotalCount() == 0 {
@@ -761,6 +2504,18 @@ func (c *TopN) MemoryUsage() (sum int64) {
 	return
 }
 
+// MemUsage returns the approximate heap bytes held by the TopN, that is the length of each encoded value plus
+// 8 bytes for each count. It is used by the analyze memory tracker.
+func (c *TopN) MemUsage() (sum int64) {
+	if c == nil {
+		return
+	}
+	for _, meta := range c.TopN {
+		sum += int64(len(meta.Encoded)) + 8
+	}
+	return
+}
+
 // queryAddTopN TopN adds count to CMSketch.topN if exists, and returns the count of such elements after insert.
 // If such elements does not in topn elements, nothing will happen and false will be returned.
 func (c *TopN) updateTopNWithDelta(d []byte, delta uint64, increase bool) bool {
@@ -784,6 +2539,28 @@ func NewTopN(n int) *TopN {
 	return &TopN{TopN: make([]TopNMeta, 0, n)}
 }
 
+// NewTopNFromMap creates the TopN with the `n` most frequent values in the map from the encoded value to its count.
+func NewTopNFromMap(m map[string]uint64, n int) *TopN {
+	metas := make([]TopNMeta, 0, len(m))
+	for encoded, count := range m {
+		metas = append(metas, TopNMeta{Encoded: []byte(encoded), Count: count})
+	}
+	topN, _ := getMergedTopNFromSortedSlice(metas, uint32(mathutil.Max(n, 0)))
+	return topN
+}
+
+// ToMap returns the map from the encoded value to its count, it is the inverse of NewTopNFromMap.
+func (c *TopN) ToMap() map[string]uint64 {
+	if c == nil {
+		return map[string]uint64{}
+	}
+	m := make(map[string]uint64, len(c.TopN))
+	for _, meta := range c.TopN {
+		m[string(meta.Encoded)] = meta.Count
+	}
+	return m
+}
+
 // MergePartTopN2GlobalTopN is used to merge the partition-level topN to global-level topN.
 // The input parameters:
 //  1. `topNs` are the partition-level topNs to be merged.
@@ -794,24 +2571,73 @@ func NewTopN(n int) *TopN {
 //  1. `*TopN` is the final global-level topN.
 //  2. `[]TopNMeta` is the left topN value from the partition-level TopNs, but is not placed to global-level TopN. We should put them back to histogram latter.
 //  3. `[]*Histogram` are the partition-level histograms which just delete some values when we merge the global-level topN.
+//
+// The merged values are ordered by the count descending, and the values with the same count are ordered by the
+// encoded bytes ascending, so among the values with equal counts at the boundary of the global-level topN, the ones
+// with the lexicographically smaller encoded bytes are kept. The result doesn't depend on the order of the values.
 func MergePartTopN2GlobalTopN(loc *time.Location, version int, topNs []*TopN, n uint32, hists []*Histogram,
 	isIndex bool, killed *uint32) (*TopN, []TopNMeta, []*Histogram, error) {
+	return MergePartTopN2GlobalTopNWithDeadline(loc, version, topNs, n, hists, isIndex, killed, time.Time{})
+}
+
+// MergePartTopN2GlobalTopNWithDeadline is the same as MergePartTopN2GlobalTopN, but it stops merging the remaining
+// partitions once the `deadline` is exceeded, a zero `deadline` means there is no deadline.
+// The deadline is checked before merging each partition like the kill flag, and at least one partition is merged.
+// When it is exceeded, the result merged from the finished partitions is returned together with ErrMergeTopNTimeout.
+func MergePartTopN2GlobalTopNWithDeadline(loc *time.Location, version int, topNs []*TopN, n uint32, hists []*Histogram,
+	isIndex bool, killed *uint32, deadline time.Time) (*TopN, []TopNMeta, []*Histogram, error) {
+	return mergePartTopN2GlobalTopN(loc, version, topNs, n, hists, isIndex, killed, deadline, nil)
+}
+
+// MergePartTopN2GlobalTopNWithBreakdown is the same as MergePartTopN2GlobalTopN, but it also returns the counts of
+// every value in the global TopN contributed by each partition, including the counts moved from the histograms, and
+// the counts are 0 for the partitions not containing the value. It's only used to debug the global stats, since
+// tracking the breakdown is expensive.
+func MergePartTopN2GlobalTopNWithBreakdown(loc *time.Location, version int, topNs []*TopN, n uint32, hists []*Histogram,
+	isIndex bool, killed *uint32) (*TopN, []TopNMeta, []*Histogram, map[string][]uint64, error) {
+	breakdown := make(map[hack.MutableString][]uint64)
+	globalTopN, leftTopN, hists, err := mergePartTopN2GlobalTopN(loc, version, topNs, n, hists, isIndex, killed, time.Time{}, breakdown)
+	if err != nil || globalTopN == nil {
+		return globalTopN, leftTopN, hists, nil, err
+	}
+	result := make(map[string][]uint64, len(globalTopN.TopN))
+	for _, meta := range globalTopN.TopN {
+		result[string(meta.Encoded)] = breakdown[hack.String(meta.Encoded)]
+	}
+	return globalTopN, leftTopN, hists, result, nil
+}
+
+// mergePartTopN2GlobalTopN records the counts contributed by each partition in the `breakdown` if it's not nil.
+func mergePartTopN2GlobalTopN(loc *time.Location, version int, topNs []*TopN, n uint32, hists []*Histogram,
+	isIndex bool, killed *uint32, deadline time.Time, breakdown map[hack.MutableString][]uint64) (*TopN, []TopNMeta, []*Histogram, error) {
 	if checkEmptyTopNs(topNs) {
 		return nil, nil, hists, nil
 	}
+	// The TopNs are looked up by binary search, so the duplicated entries are coalesced in the copies of the TopNs.
+	topNs = slices.Clone(topNs)
+	for i, topN := range topNs {
+		topNs[i] = normalizedTopN(topN)
+	}
 
 	partNum := len(topNs)
 	removeVals := make([][]TopNMeta, partNum)
 
 	// Different TopN structures may hold the same value, we have to merge them.
+	// The counts are summed up as floats and only rounded once at the end, so the tiny errors of the floating-point
+	// additions in different partition orders don't change the merged counts.
 	counter := make(map[hack.MutableString]float64)
 	// datumMap is used to store the mapping from the string type to datum type.
 	// The datum is used to find the value in the histogram.
 	datumMap := make(map[hack.MutableString]types.Datum)
+	var timeoutErr error
 	for i, topN := range topNs {
 		if atomic.LoadUint32(killed) == 1 {
 			return nil, nil, nil, errors.Trace(ErrQueryInterrupted)
 		}
+		if i > 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			timeoutErr = errors.Trace(ErrMergeTopNTimeout)
+			break
+		}
 		if topN.TotalCount() == 0 {
 			continue
 		}
@@ -819,6 +2645,12 @@ func MergePartTopN2GlobalTopN(loc *time.Location, version int, topNs []*TopN, n
 			encodedVal := hack.String(val.Encoded)
 			_, exists := counter[encodedVal]
 			counter[encodedVal] += float64(val.Count)
+			if breakdown != nil {
+				if _, ok := breakdown[encodedVal]; !ok {
+					breakdown[encodedVal] = make([]uint64, partNum)
+				}
+				breakdown[encodedVal][i] += val.Count
+			}
 			if exists {
 				// We have already calculated the encodedVal from the histogram, so just continue to next topN value.
 				continue
@@ -838,23 +2670,9 @@ func MergePartTopN2GlobalTopN(loc *time.Location, version int, topNs []*TopN, n
 				if !exists {
 					// If the datumMap does not have the encodedVal datum,
 					// we should generate the datum based on the encoded value.
-					// This part is copied from the function MergePartitionHist2GlobalHist.
-					var d types.Datum
-					if isIndex {
-						d.SetBytes(val.Encoded)
-					} else {
-						var err error
-						if types.IsTypeTime(hists[0].Tp.GetType()) {
-							// Handle date time values specially since they are encoded to int and we'll get int values if using DecodeOne.
-							_, d, err = codec.DecodeAsDateTime(val.Encoded, hists[0].Tp.GetType(), loc)
-						} else if types.IsTypeFloat(hists[0].Tp.GetType()) {
-							_, d, err = codec.DecodeAsFloat32(val.Encoded, hists[0].Tp.GetType())
-						} else {
-							_, d, err = codec.DecodeOne(val.Encoded)
-						}
-						if err != nil {
-							return nil, nil, nil, err
-						}
+					d, err := decodeTopNValue(val.Encoded, isIndex, hists[0].Tp, loc)
+					if err != nil {
+						return nil, nil, nil, err
 					}
 					datumMap[encodedVal] = d
 					datum = d
@@ -863,6 +2681,9 @@ func MergePartTopN2GlobalTopN(loc *time.Location, version int, topNs []*TopN, n
 				count, _ := hists[j].equalRowCount(nil, datum, isIndex)
 				if count != 0 {
 					counter[encodedVal] += count
+					if breakdown != nil {
+						breakdown[encodedVal][j] += uint64(count)
+					}
 					// Remove the value corresponding to encodedVal from the histogram.
 					removeVals[j] = append(removeVals[j], TopNMeta{Encoded: datum.GetBytes(), Count: uint64(count)})
 				}
@@ -882,17 +2703,256 @@ func MergePartTopN2GlobalTopN(loc *time.Location, version int, topNs []*TopN, n
 	}
 	numTop := len(counter)
 	if numTop == 0 {
-		return nil, nil, hists, nil
+		return nil, nil, hists, timeoutErr
 	}
 	sorted := make([]TopNMeta, 0, numTop)
 	for value, cnt := range counter {
 		data := hack.Slice(string(value))
-		sorted = append(sorted, TopNMeta{Encoded: data, Count: uint64(cnt)})
+		sorted = append(sorted, TopNMeta{Encoded: data, Count: uint64(math.Round(cnt))})
+	}
+	globalTopN, leftTopN := getMergedTopNFromSortedSlice(sorted, n)
+	leftTopN = keepPinnedTopN(topNs, globalTopN, leftTopN)
+	return globalTopN, leftTopN, hists, timeoutErr
+}
+
+// decodeTopNValue decodes the encoded TopN value to the datum used to find the value in the histogram.
+// This part is copied from the function MergePartitionHist2GlobalHist.
+func decodeTopNValue(encoded []byte, isIndex bool, tp *types.FieldType, loc *time.Location) (d types.Datum, err error) {
+	if isIndex {
+		d.SetBytes(encoded)
+		return d, nil
+	}
+	if types.IsTypeTime(tp.GetType()) {
+		// Handle date time values specially since they are encoded to int and we'll get int values if using DecodeOne.
+		_, d, err = codec.DecodeAsDateTime(encoded, tp.GetType(), loc)
+	} else if types.IsTypeFloat(tp.GetType()) {
+		_, d, err = codec.DecodeAsFloat32(encoded, tp.GetType())
+	} else {
+		_, d, err = codec.DecodeOne(encoded)
+	}
+	return d, err
+}
+
+// MergePartTopN2GlobalTopNStream merges the partition-level TopNs like MergePartTopN2GlobalTopN, but the TopN and
+// the histogram of every partition are pulled from `next` one by one until it returns false, so the TopNs are not
+// kept after they are added to the running candidates, e.g. for the tables with a huge number of partitions. The
+// histograms are kept since the candidates from the later partitions are looked up in them, and they are returned
+// with the merged values removed like MergePartTopN2GlobalTopN. The stats version is not needed since a value is never
+// looked up in the histogram of the partition whose TopN holds it.
+func MergePartTopN2GlobalTopNStream(loc *time.Location, next func() (*TopN, *Histogram, bool), n uint32,
+	isIndex bool, killed *uint32) (*TopN, []TopNMeta, []*Histogram, error) {
+	globalTopN, leftTopN, groupHists, err := mergeTopNGroups(loc, func() (*TopN, []*Histogram, bool) {
+		topN, hist, ok := next()
+		return topN, []*Histogram{hist}, ok
+	}, n, isIndex, killed)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hists := make([]*Histogram, 0, len(groupHists))
+	for _, group := range groupHists {
+		hists = append(hists, group[0])
+	}
+	return globalTopN, leftTopN, hists, nil
+}
+
+// MergeHierarchical merges the TopNs of the partitions in two stages, e.g. for the tables with a huge number of
+// partitions: the TopNs of every group are merged first, then the merged TopNs of the groups are merged into the global
+// TopN, `groupHists` holds the histograms of the partitions in the same layout as `groups`. The values are not dropped
+// from the merged TopN of a group, and a value of a group is looked up in the histograms of the partitions whose TopNs
+// don't hold it, so the result is the same as merging all the partitions at once by MergePartTopN2GlobalTopN. The
+// histograms are modified in place, and the values which are removed from them but not kept in the global TopN are
+// returned in the leftTopN, which are supposed to be merged into the global histogram.
+func MergeHierarchical(groups [][]*TopN, groupHists [][]*Histogram, n uint32, isIndex bool, loc *time.Location,
+	killed *uint32) (*TopN, []TopNMeta, error) {
+	if len(groups) != len(groupHists) {
+		return nil, nil, errors.Errorf("the number of the TopN groups %d doesn't match the number of the histogram groups %d",
+			len(groups), len(groupHists))
+	}
+	groupTopNs := make([]*TopN, 0, len(groups))
+	for i, topNs := range groups {
+		if len(topNs) != len(groupHists[i]) {
+			return nil, nil, errors.Errorf("the number of the TopNs %d doesn't match the number of the histograms %d in group %d",
+				len(topNs), len(groupHists[i]), i)
+		}
+		j := 0
+		groupTopN, _, _, err := mergeTopNGroups(loc, func() (*TopN, []*Histogram, bool) {
+			if j == len(topNs) {
+				return nil, nil, false
+			}
+			j++
+			return topNs[j-1], groupHists[i][j-1 : j], true
+		}, math.MaxUint32, isIndex, killed)
+		if err != nil {
+			return nil, nil, err
+		}
+		groupTopNs = append(groupTopNs, groupTopN)
+	}
+	i := 0
+	globalTopN, leftTopN, _, err := mergeTopNGroups(loc, func() (*TopN, []*Histogram, bool) {
+		if i == len(groupTopNs) {
+			return nil, nil, false
+		}
+		i++
+		return groupTopNs[i-1], groupHists[i-1], true
+	}, n, isIndex, killed)
+	return globalTopN, leftTopN, err
+}
+
+// mergeTopNGroups merges the TopNs pulled from `next`, each TopN covers a group of histograms, and a value is looked
+// up in the histograms of the groups whose TopNs don't hold it. The histograms are returned in the pulled order with
+// the merged values removed.
+func mergeTopNGroups(loc *time.Location, next func() (*TopN, []*Histogram, bool), n uint32,
+	isIndex bool, killed *uint32) (*TopN, []TopNMeta, [][]*Histogram, error) {
+	type candidate struct {
+		count uint64
+		// groups are the groups whose TopNs hold the value in ascending order,
+		// the value is looked up in the histograms of the other groups.
+		groups []int
+	}
+	candidates := make(map[string]*candidate)
+	// pinned collects the pinned values of all the TopNs.
+	pinned := &TopN{}
+	var hists [][]*Histogram
+	for {
+		if atomic.LoadUint32(killed) == 1 {
+			return nil, nil, nil, errors.Trace(ErrQueryInterrupted)
+		}
+		topN, groupHists, ok := next()
+		if !ok {
+			break
+		}
+		group := len(hists)
+		hists = append(hists, groupHists)
+		if topN == nil {
+			continue
+		}
+		for encoded := range topN.pinned {
+			pinned.Pin([]byte(encoded))
+		}
+		if topN.TotalCount() == 0 {
+			continue
+		}
+		for _, val := range topN.TopN {
+			c, ok := candidates[string(val.Encoded)]
+			if !ok {
+				c = &candidate{}
+				candidates[string(val.Encoded)] = c
+			}
+			c.count += val.Count
+			c.groups = append(c.groups, group)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, hists, nil
+	}
+
+	// Add the counts of the candidates from the histograms of the groups whose TopNs don't hold them.
+	removeVals := make([][][]TopNMeta, len(hists))
+	for i := range hists {
+		removeVals[i] = make([][]TopNMeta, len(hists[i]))
+	}
+	for encoded, c := range candidates {
+		var datum types.Datum
+		decoded := false
+		for i, groups := 0, c.groups; i < len(hists); i++ {
+			if atomic.LoadUint32(killed) == 1 {
+				return nil, nil, nil, errors.Trace(ErrQueryInterrupted)
+			}
+			if len(groups) > 0 && groups[0] == i {
+				groups = groups[1:]
+				continue
+			}
+			for j, hist := range hists[i] {
+				if hist == nil {
+					continue
+				}
+				if !decoded {
+					var err error
+					datum, err = decodeTopNValue([]byte(encoded), isIndex, hist.Tp, loc)
+					if err != nil {
+						return nil, nil, nil, err
+					}
+					decoded = true
+				}
+				count, _ := hist.equalRowCount(nil, datum, isIndex)
+				if count != 0 {
+					c.count += uint64(count)
+					removeVals[i][j] = append(removeVals[i][j], TopNMeta{Encoded: datum.GetBytes(), Count: uint64(count)})
+				}
+			}
+		}
+	}
+	// Remove the value from the Hists.
+	for i, groupVals := range removeVals {
+		for j, vals := range groupVals {
+			if len(vals) > 0 {
+				slices.SortFunc(vals, func(i, j TopNMeta) bool {
+					return bytes.Compare(i.Encoded, j.Encoded) < 0
+				})
+				hists[i][j].RemoveVals(vals)
+			}
+		}
+	}
+	sorted := make([]TopNMeta, 0, len(candidates))
+	for encoded, c := range candidates {
+		sorted = append(sorted, TopNMeta{Encoded: []byte(encoded), Count: c.count})
 	}
 	globalTopN, leftTopN := getMergedTopNFromSortedSlice(sorted, n)
+	leftTopN = keepPinnedTopN([]*TopN{pinned}, globalTopN, leftTopN)
+	return globalTopN, leftTopN, hists, nil
+}
+
+// MergePartTopN2GlobalTopNWithThreshold merges the partition-level TopNs as MergePartTopN2GlobalTopN, but the global
+// TopN only keeps the values whose count exceeds `threshold` of the total row count, and `n` caps its size. The total
+// row count includes the rows in the histograms. The other values are returned in the leftTopN, which are supposed to
+// be merged into the global histogram.
+func MergePartTopN2GlobalTopNWithThreshold(loc *time.Location, version int, topNs []*TopN, n uint32, hists []*Histogram,
+	isIndex bool, killed *uint32, threshold float64) (*TopN, []TopNMeta, []*Histogram, error) {
+	globalTopN, leftTopN, hists, err := MergePartTopN2GlobalTopN(loc, version, topNs, n, hists, isIndex, killed)
+	if err != nil || globalTopN == nil {
+		return globalTopN, leftTopN, hists, err
+	}
+	total := float64(globalTopN.TotalCount())
+	for _, meta := range leftTopN {
+		total += float64(meta.Count)
+	}
+	for _, hist := range hists {
+		if hist != nil {
+			total += hist.notNullCount()
+		}
+	}
+	kept := globalTopN.TopN[:0]
+	var dropped []TopNMeta
+	for _, meta := range globalTopN.TopN {
+		if float64(meta.Count) > threshold*total || globalTopN.IsPinned(meta.Encoded) {
+			kept = append(kept, meta)
+			continue
+		}
+		dropped = append(dropped, meta)
+	}
+	globalTopN.TopN = kept
+	// The dropped values are larger than the ones in the leftTopN, keep the leftTopN sorted by the count.
+	leftTopN = append(SortTopnMeta(dropped), leftTopN...)
 	return globalTopN, leftTopN, hists, nil
 }
 
+// EstimateLeftTopNSize returns the length of the leftTopN which MergePartTopN2GlobalTopN would return for the given
+// TopNs and `n`, without doing the merge. Only the values in the TopNs can be in the merged result, so it is the
+// number of the distinct values minus `n`. The pinned values stay in the global TopN, so it's an upper bound if
+// any value is pinned.
+func EstimateLeftTopNSize(topNs []*TopN, n int) int {
+	distinct := make(map[hack.MutableString]struct{})
+	for _, topN := range topNs {
+		if topN.TotalCount() == 0 {
+			continue
+		}
+		for _, val := range topN.TopN {
+			distinct[hack.String(val.Encoded)] = struct{}{}
+		}
+	}
+	return mathutil.Max(0, len(distinct)-n)
+}
+
 // MergeTopN is used to merge more TopN structures to generate a new TopN struct by the given size.
 // The input parameters are multiple TopN structures to be merged and the size of the new TopN that will be generated.
 // The output parameters are the newly generated TopN structure and the remaining numbers.
@@ -920,7 +2980,9 @@ func MergeTopN(topNs []*TopN, n uint32) (*TopN, []TopNMeta) {
 		data := hack.Slice(string(value))
 		sorted = append(sorted, TopNMeta{Encoded: data, Count: cnt})
 	}
-	return getMergedTopNFromSortedSlice(sorted, n)
+	mergedTopN, leftTopN := getMergedTopNFromSortedSlice(sorted, n)
+	leftTopN = keepPinnedTopN(topNs, mergedTopN, leftTopN)
+	return mergedTopN, leftTopN
 }
 
 func checkEmptyTopNs(topNs []*TopN) bool {
@@ -933,27 +2995,26 @@ func checkEmptyTopNs(topNs []*TopN) bool {
 
 // SortTopnMeta sort topnMeta
 func SortTopnMeta(topnMetas []TopNMeta) []TopNMeta {
-	slices.SortFunc(topnMetas, func(i, j TopNMeta) bool {
-		if i.Count != j.Count {
-			return i.Count > j.Count
-		}
-		return bytes.Compare(i.Encoded, j.Encoded) < 0
-	})
+	slices.SortFunc(topnMetas, lessByCount)
 	return topnMetas
 }
 
+func lessByCount(i, j TopNMeta) bool {
+	if i.Count != j.Count {
+		return i.Count > j.Count
+	}
+	return bytes.Compare(i.Encoded, j.Encoded) < 0
+}
+
 // GetMergedTopNFromSortedSlice returns merged topn
 func GetMergedTopNFromSortedSlice(sorted []TopNMeta, n uint32) (*TopN, []TopNMeta) {
 	return getMergedTopNFromSortedSlice(sorted, n)
 }
 
+// getMergedTopNFromSortedSlice keeps the `n` values with the highest counts, the ties are broken by the encoded bytes
+// ascending, see lessByCount.
 func getMergedTopNFromSortedSlice(sorted []TopNMeta, n uint32) (*TopN, []TopNMeta) {
-	slices.SortFunc(sorted, func(i, j TopNMeta) bool {
-		if i.Count != j.Count {
-			return i.Count > j.Count
-		}
-		return bytes.Compare(i.Encoded, j.Encoded) < 0
-	})
+	slices.SortFunc(sorted, lessByCount)
 	n = mathutil.Min(uint32(len(sorted)), n)
 
 	var finalTopN TopN
@@ -15,19 +15,28 @@
 package statistics
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/failpoint"
 	"github.com/pingcap/tidb/parser/mysql"
 	"github.com/pingcap/tidb/sessionctx/stmtctx"
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/chunk"
 	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/mathutil"
 	"github.com/stretchr/testify/require"
+	"github.com/twmb/murmur3"
+	"golang.org/x/exp/slices"
 )
 
 func (c *CMSketch) insert(val *types.Datum) error {
@@ -149,6 +158,105 @@ func TestCMSketch(t *testing.T) {
 	}
 }
 
+func TestCMSketchMeanMinNotWorseThanMin(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	for _, seed := range []int64{0, 1} {
+		cms, mp, err := buildCMSketchAndMap(d, w, seed, total, imax, 1.1)
+		require.NoError(t, err)
+		meanMinErr, err := averageAbsoluteError(cms, nil, mp)
+		require.NoError(t, err)
+		// The raw minimum counter overestimates the count by the noise of the collisions.
+		var minErr uint64
+		for num, count := range mp {
+			bytes, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+			require.NoError(t, err)
+			min := uint32(math.MaxUint32)
+			for _, counter := range cms.RowEstimates(bytes) {
+				min = mathutil.Min(min, counter)
+			}
+			require.GreaterOrEqual(t, min, count)
+			minErr += uint64(min - count)
+		}
+		minErr /= uint64(len(mp))
+		require.LessOrEqual(t, meanMinErr, minErr)
+	}
+}
+
+func TestCMSketchQueryBytesWithError(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	within := 0
+	for num, count := range mp {
+		bytes, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		estimate, maxError := cms.QueryBytesWithError(bytes)
+		require.Equal(t, cms.TotalCount()/uint64(w), maxError)
+		require.GreaterOrEqual(t, estimate, uint64(count))
+		if estimate-uint64(count) <= maxError {
+			within++
+		}
+	}
+	require.GreaterOrEqual(t, float64(within), 0.9*float64(len(mp)))
+
+	estimate, maxError := NewCMSketch(d, w).QueryBytesWithError([]byte("a"))
+	require.Equal(t, uint64(0), estimate)
+	require.Equal(t, uint64(0), maxError)
+}
+
+func TestCMSketchDecay(t *testing.T) {
+	cms := NewCMSketch(5, 2048)
+	insertBatch := func() {
+		for i := 0; i < 100; i++ {
+			cms.InsertBytesByCount([]byte(fmt.Sprintf("key%d", i)), 10)
+		}
+	}
+	insertBatch()
+	single := make([]uint64, 100)
+	for i := range single {
+		single[i] = cms.QueryBytes([]byte(fmt.Sprintf("key%d", i)))
+	}
+	cms.SetDefaultValue(4)
+	require.NoError(t, cms.Decay(0.5))
+	require.Equal(t, uint64(500), cms.TotalCount())
+	require.Equal(t, uint64(2), cms.DefaultValue())
+	cms.SetDefaultValue(0)
+
+	// The keys of the first batch are weighted by 0.5 after the decay.
+	insertBatch()
+	for i := range single {
+		estimate := cms.QueryBytes([]byte(fmt.Sprintf("key%d", i)))
+		require.InDelta(t, 1.5*float64(single[i]), float64(estimate), 0.1*float64(single[i]))
+	}
+
+	require.Error(t, cms.Decay(0))
+	require.Error(t, cms.Decay(1.5))
+}
+
+func TestCMSketchQueryValueFloored(t *testing.T) {
+	cms := NewCMSketch(5, 2048)
+	cms.InsertBytesByCount([]byte("hot"), 1000)
+	cms.InsertBytesByCount([]byte("warm"), 30)
+	topN := NewTopN(2)
+	topN.AppendTopN([]byte("a"), 500)
+	topN.AppendTopN([]byte("b"), 200)
+	topN.Sort()
+
+	require.Equal(t, uint64(500), cms.QueryValueFloored([]byte("a"), topN))
+	// The estimation larger than the smallest count in the TopN is capped.
+	require.Equal(t, uint64(1000), cms.QueryBytes([]byte("hot")))
+	require.Equal(t, uint64(200), cms.QueryValueFloored([]byte("hot"), topN))
+	require.Equal(t, uint64(30), cms.QueryValueFloored([]byte("warm"), topN))
+	// The absent value is estimated as the default value at least.
+	require.Equal(t, uint64(0), cms.QueryValueFloored([]byte("absent"), topN))
+	cms.SetDefaultValue(5)
+	require.Equal(t, uint64(5), cms.QueryValueFloored([]byte("absent"), topN))
+	// No cap without the TopN.
+	require.Equal(t, uint64(1000), cms.QueryValueFloored([]byte("hot"), nil))
+}
+
 func TestCMSketchCoding(t *testing.T) {
 	lSketch := NewCMSketch(5, 2048)
 	lSketch.count = 2048 * math.MaxUint32
@@ -163,6 +271,177 @@ func TestCMSketchCoding(t *testing.T) {
 	rSketch, _, err := DecodeCMSketchAndTopN(bytes, nil)
 	require.NoError(t, err)
 	require.True(t, lSketch.Equal(rSketch))
+	assertRoundTripStable(t, lSketch, nil, nil)
+}
+
+func TestCMSketchEncodingVersion(t *testing.T) {
+	cms, _, err := buildCMSketchAndMap(5, 2048, 0, 10000, 100000, 1.1)
+	require.NoError(t, err)
+	legacy, err := CMSketchToProto(cms, nil).Marshal()
+	require.NoError(t, err)
+	data, err := EncodeCMSketchWithoutTopN(cms)
+	require.NoError(t, err)
+	// The data is written without the version byte, so the old versions can decode it.
+	require.Equal(t, legacy, data)
+	require.Greater(t, data[0], byte(maxCMSketchEncodingVersion))
+
+	// Both the data without the version byte, i.e. the version 0, and the one prefixed by the version 1 are decoded.
+	data = append([]byte{cmSketchEncodingVersion}, legacy...)
+	for _, encoded := range [][]byte{legacy, data} {
+		decoded, _, err := DecodeCMSketchAndTopN(encoded, nil)
+		require.NoError(t, err)
+		require.True(t, cms.Equal(decoded))
+	}
+
+	data[0] = cmSketchEncodingVersionRLE + 1
+	_, _, err = DecodeCMSketchAndTopN(data, nil)
+	require.EqualError(t, err, "unsupported encoding version 3 of Count-Min Sketch, the latest supported version is 2")
+}
+
+func TestCMSketchCompressedCoding(t *testing.T) {
+	// The saturated CMSketch is not compressed.
+	lSketch := NewCMSketch(5, 2048)
+	lSketch.count = 2048 * math.MaxUint32
+	for i := range lSketch.table {
+		for j := range lSketch.table[i] {
+			lSketch.table[i][j] = math.MaxUint32
+		}
+	}
+	plain, err := EncodeCMSketchWithoutTopN(lSketch)
+	require.NoError(t, err)
+	compressed, err := EncodeCMSketchCompressed(lSketch)
+	require.NoError(t, err)
+	require.Equal(t, plain, compressed)
+
+	// The CMSketch of 1000 distinct keys has at most 1000 non-zero counters in every row.
+	cms, mp, err := buildCMSketchAndMap(5, 2048, 0, 1000, 1000, 1.1)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(mp), 1000)
+	cms.SetDefaultValue(3)
+	plain, err = EncodeCMSketchWithoutTopN(cms)
+	require.NoError(t, err)
+	compressed, err = EncodeCMSketchCompressed(cms)
+	require.NoError(t, err)
+	require.Equal(t, byte(cmSketchEncodingVersionRLE), compressed[0])
+	require.Less(t, len(compressed), len(plain)/2)
+	decoded, _, err := DecodeCMSketchAndTopN(compressed, nil)
+	require.NoError(t, err)
+	require.True(t, cms.Equal(decoded))
+
+	// An empty CMSketch is compressed to a few bytes.
+	compressed, err = EncodeCMSketchCompressed(NewCMSketch(5, 2048))
+	require.NoError(t, err)
+	decoded, _, err = DecodeCMSketchAndTopN(compressed, nil)
+	require.NoError(t, err)
+	require.True(t, NewCMSketch(5, 2048).Equal(decoded))
+
+	_, _, err = DecodeCMSketchAndTopN(compressed[:len(compressed)-1], nil)
+	require.Error(t, err)
+
+	rle := func(vals ...uint64) []byte {
+		data := []byte{cmSketchEncodingVersionRLE}
+		for _, v := range vals {
+			data = binary.AppendUvarint(data, v)
+		}
+		return data
+	}
+	// The truncated header.
+	_, _, err = DecodeCMSketchAndTopN(rle(2), nil)
+	require.Error(t, err)
+	// The oversized header is rejected before allocating the rows.
+	_, _, err = DecodeCMSketchAndTopN(rle(2, math.MaxInt32, 0, math.MaxInt32, 0, math.MaxInt32, 0), nil)
+	require.ErrorContains(t, err, "exceed the limit")
+	_, _, err = DecodeCMSketchAndTopN(rle(maxDecodedCMSketchSize, 2, 0, 2, 0), nil)
+	require.ErrorContains(t, err, "exceed the limit")
+	// The depth is more than the rows the remaining bytes can encode.
+	_, _, err = DecodeCMSketchAndTopN(rle(3, 2048, 0, 2048, 0, 2048, 0)[:8], nil)
+	require.Error(t, err)
+	decoded, _, err = DecodeCMSketchAndTopN(rle(2, 4, 0, 4, 0, 1, 5, 2, 0), nil)
+	require.NoError(t, err)
+	width, depth := decoded.GetWidthAndDepth()
+	require.Equal(t, int32(4), width)
+	require.Equal(t, int32(2), depth)
+	require.Equal(t, uint32(5), decoded.table[1][1])
+}
+
+// assertRoundTripStable encodes the CMSketch, decodes it with the TopN rows and re-encodes the decoded one, and asserts
+// that the encoded bytes are identical and the decoded CMSketch and TopN are equal to the given ones, which catches
+// the non-deterministic encoding.
+func assertRoundTripStable(t require.TestingT, cms *CMSketch, topN *TopN, rows []chunk.Row) {
+	assertRoundTripStableWithEncoder(t, EncodeCMSketchWithoutTopN, cms, topN, rows)
+}
+
+func assertRoundTripStableWithEncoder(t require.TestingT, encode func(*CMSketch) ([]byte, error), cms *CMSketch, topN *TopN, rows []chunk.Row) {
+	data, err := encode(cms)
+	require.NoError(t, err)
+	decodedCMS, decodedTopN, err := DecodeCMSketchAndTopN(data, rows)
+	require.NoError(t, err)
+	require.True(t, cms.Equal(decodedCMS))
+	require.True(t, topN.Equal(decodedTopN))
+	reencoded, err := encode(decodedCMS)
+	require.NoError(t, err)
+	require.Equal(t, data, reencoded)
+}
+
+// failureRecorder records the failure instead of stopping the test.
+type failureRecorder struct {
+	failed bool
+}
+
+func (r *failureRecorder) Errorf(string, ...interface{}) {
+	r.failed = true
+}
+
+func (r *failureRecorder) FailNow() {
+	r.failed = true
+}
+
+func TestAssertRoundTripStable(t *testing.T) {
+	cms, _, err := buildCMSketchAndMap(5, 2048, 0, 10000, 100000, 1.1)
+	require.NoError(t, err)
+	assertRoundTripStable(t, cms, nil, nil)
+
+	// The encoding depends on a hidden state, so it's different every time.
+	calls := uint64(0)
+	unstable := func(c *CMSketch) ([]byte, error) {
+		calls++
+		p := CMSketchToProto(c, nil)
+		p.DefaultValue += calls
+		return p.Marshal()
+	}
+	recorder := &failureRecorder{}
+	assertRoundTripStableWithEncoder(recorder, unstable, cms, nil, nil)
+	require.True(t, recorder.failed)
+}
+
+func TestCMSketchJSONCoding(t *testing.T) {
+	lSketch := NewCMSketch(5, 2048)
+	lSketch.count = 2048 * math.MaxUint32
+	lSketch.defaultValue = 10
+	for i := range lSketch.table {
+		for j := range lSketch.table[i] {
+			lSketch.table[i][j] = math.MaxUint32
+		}
+	}
+	data, err := json.Marshal(lSketch)
+	require.NoError(t, err)
+	rSketch := &CMSketch{}
+	require.NoError(t, json.Unmarshal(data, rSketch))
+	require.True(t, lSketch.Equal(rSketch))
+
+	lTopN := NewTopN(2)
+	lTopN.AppendTopN([]byte("a"), 10)
+	lTopN.AppendTopN([]byte{0x1, 0xff}, 5)
+	data, err = json.Marshal(lTopN)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"encoded":"61","count":10},{"encoded":"01ff","count":5}]`, string(data))
+	rTopN := &TopN{}
+	require.NoError(t, json.Unmarshal(data, rTopN))
+	require.True(t, lTopN.Equal(rTopN))
+
+	// The table should match the dimensions.
+	require.Error(t, json.Unmarshal([]byte(`{"depth":2,"width":2,"table":[[1,2]]}`), &CMSketch{}))
+	require.Error(t, json.Unmarshal([]byte(`[{"encoded":"zz","count":1}]`), &TopN{}))
 }
 
 func TestCMSketchTopN(t *testing.T) {
@@ -203,6 +482,62 @@ func TestCMSketchTopN(t *testing.T) {
 	}
 }
 
+func TestNewCMSketchAndTopNWithCapacity(t *testing.T) {
+	// Make the values with the same count in the same order, so the TopNs are the same.
+	require.NoError(t, failpoint.Enable("github.com/pingcap/tidb/statistics/StabilizeV1AnalyzeTopN", `return(true)`))
+	defer func() {
+		require.NoError(t, failpoint.Disable("github.com/pingcap/tidb/statistics/StabilizeV1AnalyzeTopN"))
+	}()
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(1000000), uint64(1000000)
+	for _, zipfFactor := range []float64{1.0000001, 1.1, 2, 5} {
+		zipf := rand.NewZipf(rand.New(rand.NewSource(0)), zipfFactor, 1, imax)
+		sample := make([][]byte, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			bytes, err := codec.EncodeValue(nil, nil, types.NewIntDatum(int64(zipf.Uint64())))
+			require.NoError(t, err)
+			sample = append(sample, bytes)
+		}
+		cms, topN, ndv, scaleRatio := NewCMSketchAndTopN(d, w, sample, 20, total)
+		for _, topNCap := range []int{0, 20, 100} {
+			cms1, topN1, ndv1, scaleRatio1 := NewCMSketchAndTopNWithCapacity(d, w, sample, 20, total, topNCap)
+			require.True(t, cms.Equal(cms1))
+			require.True(t, topN.Equal(topN1))
+			require.Equal(t, ndv, ndv1)
+			require.Equal(t, scaleRatio, scaleRatio1)
+			if topN1 != nil {
+				require.GreaterOrEqual(t, cap(topN1.TopN), topNCap)
+			}
+		}
+	}
+}
+
+func TestTopNCoverageRatio(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(1000000), uint64(1000000)
+	// Almost all the rows are the TopN values if the most data lies in a narrow range.
+	cms, topN, _, err := buildCMSketchTopNAndMap(d, w, 20, 1000, 0, total, imax, 5)
+	require.NoError(t, err)
+	require.Greater(t, topN.CoverageRatio(total), 0.95)
+	require.Less(t, float64(cms.ResidualCount()), 0.05*float64(total))
+
+	// The TopN only covers the fraction of its values for the flat distribution.
+	_, topN, mp, err := buildCMSketchTopNAndMap(d, w, 20, 1000, 0, total, imax, 1.0000001)
+	require.NoError(t, err)
+	require.NotNil(t, topN)
+	covered := uint64(0)
+	for _, meta := range topN.TopN {
+		_, datum, err := codec.DecodeOne(meta.Encoded)
+		require.NoError(t, err)
+		covered += uint64(mp[datum.GetInt64()])
+	}
+	require.Less(t, topN.CoverageRatio(total), 0.5)
+	require.InDelta(t, float64(covered)/float64(total), topN.CoverageRatio(total), 0.1)
+
+	require.Equal(t, float64(0), topN.CoverageRatio(0))
+	require.Equal(t, uint64(0), (*CMSketch)(nil).ResidualCount())
+}
+
 func TestMergeCMSketch4IncrementalAnalyze(t *testing.T) {
 	tests := []struct {
 		zipfFactor float64
@@ -253,6 +588,70 @@ func TestMergeCMSketch4IncrementalAnalyze(t *testing.T) {
 	}
 }
 
+func TestMergeCMSketchAndTopN4IncrementalAnalyze(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	lSketch, rSketch := NewCMSketch(d, w), NewCMSketch(d, w)
+	lTopN, rTopN := NewTopN(2), NewTopN(2)
+	for i, count := range []uint64{100, 80} {
+		lTopN.AppendTopN([]byte(fmt.Sprintf("l%d", i)), count)
+	}
+	for i, count := range []uint64{90, 10} {
+		rTopN.AppendTopN([]byte(fmt.Sprintf("r%d", i)), count)
+	}
+	lTopN.Sort()
+	rTopN.Sort()
+
+	total := lTopN.TotalCount() + rTopN.TotalCount()
+	demoted, droppedMass, err := lSketch.MergeCMSketchAndTopN4IncrementalAnalyze(rSketch, lTopN, rTopN, 2)
+	require.NoError(t, err)
+	require.Equal(t, []TopNMeta{{Encoded: []byte("l1"), Count: 80}, {Encoded: []byte("r1"), Count: 10}}, demoted)
+	require.Equal(t, []TopNMeta{{Encoded: []byte("l0"), Count: 100}, {Encoded: []byte("r0"), Count: 90}}, lTopN.TopN)
+	require.Equal(t, uint64(90), droppedMass)
+	require.Equal(t, total, droppedMass+lTopN.TotalCount())
+	// The demoted values are folded into the CMSketch.
+	require.Equal(t, uint64(90), lSketch.TotalCount())
+	for _, meta := range demoted {
+		for _, counter := range lSketch.RowEstimates(meta.Encoded) {
+			require.GreaterOrEqual(t, uint64(counter), meta.Count)
+		}
+	}
+	width, depth := lSketch.GetWidthAndDepth()
+	require.Equal(t, w, width)
+	require.Equal(t, d, depth)
+
+	_, _, err = lSketch.MergeCMSketchAndTopN4IncrementalAnalyze(NewCMSketch(d, w/2), lTopN, rTopN, 2)
+	require.Error(t, err)
+
+	// Nothing is dropped if all the values fit in the TopN.
+	lTopN, rTopN = NewTopN(1), NewTopN(1)
+	lTopN.AppendTopN([]byte("a"), 10)
+	rTopN.AppendTopN([]byte("b"), 20)
+	demoted, droppedMass, err = NewCMSketch(d, w).MergeCMSketchAndTopN4IncrementalAnalyze(NewCMSketch(d, w), lTopN, rTopN, 2)
+	require.NoError(t, err)
+	require.Empty(t, demoted)
+	require.Equal(t, uint64(0), droppedMass)
+	require.Equal(t, uint64(30), lTopN.TotalCount())
+}
+
+func TestCMSketchMergeMax(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(10000), uint64(100000)
+	lSketch, _, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	rSketch, _, err := buildCMSketchAndMapWithOffset(d, w, 1, 2*total, imax, 1.1, int64(imax))
+	require.NoError(t, err)
+	merged := lSketch.Copy()
+	require.NoError(t, merged.MergeMax(rSketch))
+	for i := range merged.table {
+		for j := range merged.table[i] {
+			require.Equal(t, mathutil.Max(lSketch.table[i][j], rSketch.table[i][j]), merged.table[i][j])
+		}
+	}
+	require.Equal(t, 2*total, merged.TotalCount())
+
+	require.Error(t, merged.MergeMax(NewCMSketch(d, w/2)))
+}
+
 func TestCMSketchTopNUniqueData(t *testing.T) {
 	d, w := int32(5), int32(2048)
 	total := uint64(1000000)
@@ -269,11 +668,34 @@ func TestCMSketchTopNUniqueData(t *testing.T) {
 	require.NoError(t, err)
 	avg, err := averageAbsoluteError(cms, topN, mp)
 	require.NoError(t, err)
-	require.Equal(t, uint64(1), cms.defaultValue)
+	require.Equal(t, uint64(1), cms.DefaultValue())
 	require.Equal(t, uint64(0), avg)
 	require.Nil(t, topN)
 }
 
+func TestCMSketchQueryValueStrict(t *testing.T) {
+	vals := make([]*types.Datum, 0, 1000)
+	for i := int64(0); i < 1000; i++ {
+		val := types.NewIntDatum(i)
+		vals = append(vals, &val)
+	}
+	cms, _, err := prepareCMSAndTopN(5, 2048, vals, uint32(20), 1000000)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), cms.DefaultValue())
+
+	// 1006 is not inserted, and it collides with the inserted values in some rows but not all of them.
+	unseen, err := codec.EncodeValue(nil, nil, types.NewIntDatum(1006))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), cms.QueryValueStrict(unseen))
+	require.Equal(t, cms.DefaultValue(), cms.QueryBytes(unseen))
+
+	for _, val := range vals {
+		bytes, err := codec.EncodeValue(nil, nil, *val)
+		require.NoError(t, err)
+		require.LessOrEqual(t, cms.QueryValueStrict(bytes), cms.QueryBytes(bytes))
+	}
+}
+
 func TestCMSketchCodingTopN(t *testing.T) {
 	lSketch := NewCMSketch(5, 2048)
 	lSketch.count = 2048 * (math.MaxUint32)
@@ -301,11 +723,42 @@ func TestCMSketchCodingTopN(t *testing.T) {
 	rSketch, _, err := DecodeCMSketchAndTopN(bytes, rows)
 	require.NoError(t, err)
 	require.True(t, lSketch.Equal(rSketch))
+	assertRoundTripStable(t, lSketch, &TopN{TopN: topN}, rows)
 	// do not panic
 	_, _, err = DecodeCMSketchAndTopN([]byte{}, rows)
 	require.NoError(t, err)
 }
 
+func TestDecodeCMSketchAndTopNWithMinCount(t *testing.T) {
+	lSketch := NewCMSketch(5, 2048)
+	unsignedLong := types.NewFieldType(mysql.TypeLonglong)
+	unsignedLong.AddFlag(mysql.UnsignedFlag)
+	chk := chunk.New([]*types.FieldType{types.NewFieldType(mysql.TypeBlob), unsignedLong}, 10, 10)
+	var rows []chunk.Row
+	for i := 0; i < 10; i++ {
+		chk.AppendBytes(0, []byte(fmt.Sprintf("%d", i)))
+		chk.AppendUint64(1, uint64(i*10))
+		rows = append(rows, chk.GetRow(i))
+	}
+	bytes, err := EncodeCMSketchWithoutTopN(lSketch)
+	require.NoError(t, err)
+
+	cms, topN, err := DecodeCMSketchAndTopNWithMinCount(bytes, rows, 50)
+	require.NoError(t, err)
+	require.Equal(t, 5, topN.Num())
+	for _, meta := range topN.TopN {
+		require.GreaterOrEqual(t, meta.Count, uint64(50))
+	}
+	// The skipped values are estimated by the CMSketch.
+	require.Equal(t, uint64(0+10+20+30+40), cms.TotalCount())
+	require.Equal(t, uint64(40), cms.QueryBytes([]byte("4")))
+
+	// No row is skipped without the threshold.
+	_, topN, err = DecodeCMSketchAndTopN(bytes, rows)
+	require.NoError(t, err)
+	require.Equal(t, 10, topN.Num())
+}
+
 func TestMergePartTopN2GlobalTopNWithoutHists(t *testing.T) {
 	loc := time.UTC
 	sc := &stmtctx.StatementContext{TimeZone: loc}
@@ -337,14 +790,40 @@ func TestMergePartTopN2GlobalTopNWithoutHists(t *testing.T) {
 	require.Len(t, globalTopN.TopN, 2, "should only have 2 topN")
 	require.Equal(t, uint64(50), globalTopN.TotalCount(), "should have 50 rows")
 	require.Len(t, leftTopN, 1, "should have 1 left topN")
+	require.Equal(t, len(leftTopN), EstimateLeftTopNSize(topNs, 2))
 }
 
-func TestMergePartTopN2GlobalTopNWithHists(t *testing.T) {
+func TestMergePartTopN2GlobalTopNKeepTiesDeterministically(t *testing.T) {
 	loc := time.UTC
 	sc := &stmtctx.StatementContext{TimeZone: loc}
-	version := 1
 	isKilled := uint32(0)
+	keys := make([][]byte, 0, 3)
+	for i := 1; i <= 3; i++ {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(int64(i)))
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+
+	rnd := rand.New(rand.NewSource(0))
+	for run := 0; run < 20; run++ {
+		// All the keys have the same merged count 10 * 4 = 40, and they are appended in random orders.
+		topNs := make([]*TopN, 0, 4)
+		for i := 0; i < 4; i++ {
+			topN := NewTopN(3)
+			for _, j := range rnd.Perm(len(keys)) {
+				topN.AppendTopN(keys[j], 10)
+			}
+			topNs = append(topNs, topN)
+		}
+		globalTopN, leftTopN, _, err := MergePartTopN2GlobalTopN(loc, 1, topNs, 2, nil, false, &isKilled)
+		require.NoError(t, err)
+		require.Equal(t, []TopNMeta{{Encoded: keys[0], Count: 40}, {Encoded: keys[1], Count: 40}}, globalTopN.TopN)
+		require.Equal(t, []TopNMeta{{Encoded: keys[2], Count: 40}}, leftTopN)
+	}
+}
 
+// prepareTopNsAndHistsForMerge prepares the partition-level TopNs and histograms of 10 partitions for merging.
+func prepareTopNsAndHistsForMerge(t *testing.T, sc *stmtctx.StatementContext) ([]*TopN, []*Histogram) {
 	// Prepare TopNs.
 	topNs := make([]*TopN, 0, 10)
 	for i := 0; i < 10; i++ {
@@ -381,6 +860,15 @@ func TestMergePartTopN2GlobalTopNWithHists(t *testing.T) {
 		h.Buckets = append(h.Buckets, Bucket{Repeat: 10, Count: 40})
 		hists = append(hists, h)
 	}
+	return topNs, hists
+}
+
+func TestMergePartTopN2GlobalTopNWithHists(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	version := 1
+	isKilled := uint32(0)
+	topNs, hists := prepareTopNsAndHistsForMerge(t, sc)
 
 	// Test merge 2 topN.
 	globalTopN, leftTopN, _, err := MergePartTopN2GlobalTopN(loc, version, topNs, 2, hists, false, &isKilled)
@@ -388,6 +876,113 @@ func TestMergePartTopN2GlobalTopNWithHists(t *testing.T) {
 	require.Len(t, globalTopN.TopN, 2, "should only have 2 topN")
 	require.Equal(t, uint64(55), globalTopN.TotalCount(), "should have 55")
 	require.Len(t, leftTopN, 1, "should have 1 left topN")
+	require.Equal(t, len(leftTopN), EstimateLeftTopNSize(topNs, 2))
+}
+
+func TestMergePartTopN2GlobalTopNStream(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	isKilled := uint32(0)
+	for _, version := range []int{1, 2} {
+		topNs, hists := prepareTopNsAndHistsForMerge(t, sc)
+		globalTopN, leftTopN, hists, err := MergePartTopN2GlobalTopN(loc, version, topNs, 2, hists, false, &isKilled)
+		require.NoError(t, err)
+
+		streamTopNs, streamHists := prepareTopNsAndHistsForMerge(t, sc)
+		i := 0
+		next := func() (*TopN, *Histogram, bool) {
+			if i >= len(streamTopNs) {
+				return nil, nil, false
+			}
+			i++
+			return streamTopNs[i-1], streamHists[i-1], true
+		}
+		streamGlobalTopN, streamLeftTopN, streamHists, err := MergePartTopN2GlobalTopNStream(loc, next, 2, false, &isKilled)
+		require.NoError(t, err)
+		require.True(t, globalTopN.Equal(streamGlobalTopN))
+		require.Equal(t, leftTopN, streamLeftTopN)
+		require.Len(t, streamHists, len(hists))
+		for j := range hists {
+			require.Equal(t, hists[j].Buckets, streamHists[j].Buckets)
+		}
+	}
+
+	// The merging is interrupted if it is killed.
+	isKilled = 1
+	topNs, hists := prepareTopNsAndHistsForMerge(t, sc)
+	next := func() (*TopN, *Histogram, bool) {
+		return topNs[0], hists[0], true
+	}
+	_, _, _, err := MergePartTopN2GlobalTopNStream(loc, next, 2, false, &isKilled)
+	require.True(t, ErrQueryInterrupted.Equal(err))
+}
+
+func TestMergeHierarchical(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	isKilled := uint32(0)
+	topNs, hists := prepareTopNsAndHistsForMerge(t, sc)
+	globalTopN, leftTopN, hists, err := MergePartTopN2GlobalTopN(loc, 2, topNs, 2, hists, false, &isKilled)
+	require.NoError(t, err)
+
+	// The key3 is only in the TopNs of the even partitions, so it's looked up in the histograms of the
+	// other group when the partitions are grouped by the parity.
+	for _, groupOf := range []func(int) int{
+		func(i int) int { return i / 5 },
+		func(i int) int { return i % 2 },
+	} {
+		partTopNs, partHists := prepareTopNsAndHistsForMerge(t, sc)
+		groups := make([][]*TopN, 2)
+		groupHists := make([][]*Histogram, 2)
+		for i := range partTopNs {
+			groups[groupOf(i)] = append(groups[groupOf(i)], partTopNs[i])
+			groupHists[groupOf(i)] = append(groupHists[groupOf(i)], partHists[i])
+		}
+		mergedTopN, mergedLeftTopN, err := MergeHierarchical(groups, groupHists, 2, false, loc, &isKilled)
+		require.NoError(t, err)
+		require.True(t, globalTopN.Equal(mergedTopN))
+		require.Equal(t, leftTopN, mergedLeftTopN)
+		for i := range partHists {
+			require.Equal(t, hists[i].Buckets, partHists[i].Buckets)
+		}
+	}
+
+	_, _, err = MergeHierarchical(make([][]*TopN, 2), make([][]*Histogram, 1), 2, false, loc, &isKilled)
+	require.Error(t, err)
+}
+
+func TestMergePartTopN2GlobalTopNWithDeadline(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	version := 1
+	isKilled := uint32(0)
+
+	// Prepare TopNs.
+	topNs := make([]*TopN, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		// Construct TopN, should be key1 -> 2, key2 -> 2, key3 -> 3.
+		topN := NewTopN(3)
+		for j, cnt := range []uint64{2, 2, 3} {
+			key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(int64(j+1)))
+			require.NoError(t, err)
+			topN.AppendTopN(key, cnt)
+		}
+		topNs = append(topNs, topN)
+	}
+
+	// The deadline has been exceeded, so only the first partition is merged.
+	globalTopN, leftTopN, _, err := MergePartTopN2GlobalTopNWithDeadline(loc, version, topNs, 2, nil, false, &isKilled, time.Now())
+	require.True(t, ErrMergeTopNTimeout.Equal(err))
+	require.Len(t, globalTopN.TopN, 2, "should only have 2 topN")
+	require.Equal(t, uint64(5), globalTopN.TotalCount(), "should have 5 rows")
+	require.Len(t, leftTopN, 1, "should have 1 left topN")
+	require.Equal(t, uint64(2), leftTopN[0].Count)
+
+	// No deadline.
+	globalTopN, leftTopN, _, err = MergePartTopN2GlobalTopNWithDeadline(loc, version, topNs, 2, nil, false, &isKilled, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5000), globalTopN.TotalCount())
+	require.Len(t, leftTopN, 1)
 }
 
 // cmd: go test -run=^$ -bench=BenchmarkMergePartTopN2GlobalTopNWithHists -benchmem github.com/pingcap/tidb/statistics
@@ -464,3 +1059,1828 @@ func BenchmarkMergePartTopN2GlobalTopNWithHists1000000(b *testing.B) {
 func BenchmarkMergePartTopN2GlobalTopNWithHists10000000(b *testing.B) {
 	benchmarkMergePartTopN2GlobalTopNWithHists(10000000, b)
 }
+
+func TestCMSketchEncodeRows(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	lSketch, lMap, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+
+	bytes, err := lSketch.EncodeRows(3)
+	require.NoError(t, err)
+	full, err := EncodeCMSketchWithoutTopN(lSketch)
+	require.NoError(t, err)
+	require.Less(t, len(bytes), len(full))
+
+	rSketch, err := DecodeCMSketchRows(bytes)
+	require.NoError(t, err)
+	width, depth := rSketch.GetWidthAndDepth()
+	require.Equal(t, w, width)
+	require.Equal(t, int32(3), depth)
+	require.Equal(t, lSketch.count, rSketch.count)
+	require.Equal(t, lSketch.defaultValue, rSketch.defaultValue)
+	for i := range rSketch.table {
+		require.Equal(t, lSketch.table[i], rSketch.table[i])
+	}
+	// The minimum counter of the remaining rows never underestimates.
+	for num, count := range lMap {
+		val := types.NewIntDatum(num)
+		data, err := codec.EncodeValue(nil, nil, val)
+		require.NoError(t, err)
+		h1, h2 := murmur3.Sum128(data)
+		min := uint32(math.MaxUint32)
+		for i := range rSketch.table {
+			j := (h1 + h2*uint64(i)) % uint64(rSketch.width)
+			min = mathutil.Min(min, rSketch.table[i][j])
+		}
+		require.GreaterOrEqual(t, min, count)
+	}
+
+	_, err = lSketch.EncodeRows(0)
+	require.Error(t, err)
+	_, err = lSketch.EncodeRows(6)
+	require.Error(t, err)
+}
+
+func TestCMSketchDefaultValue(t *testing.T) {
+	d, w := int32(5), int32(16)
+	cms := NewCMSketch(d, w)
+	// Every counter is equal to the noise, so the values which are not inserted are estimated by the default value.
+	for i := range cms.table {
+		for j := range cms.table[i] {
+			cms.table[i][j] = 10
+		}
+	}
+	cms.count = uint64(w) * 10
+	require.Equal(t, uint64(0), cms.DefaultValue())
+
+	cms.SetDefaultValue(7)
+	require.Equal(t, uint64(7), cms.DefaultValue())
+	count, err := queryValue(nil, cms, nil, types.NewIntDatum(1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), count)
+
+	var nilCMS *CMSketch
+	nilCMS.SetDefaultValue(7)
+	require.Equal(t, uint64(0), nilCMS.DefaultValue())
+}
+
+func TestCMSketchHottestCells(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	cms := NewCMSketch(d, w)
+	heavy := []byte("heavy hitter")
+	cms.InsertBytesByCount(heavy, 10000)
+	for i := 0; i < 1000; i++ {
+		cms.InsertBytes([]byte(fmt.Sprintf("light%d", i)))
+	}
+
+	cells := cms.HottestCells(int(d))
+	require.Len(t, cells, int(d))
+	h1, h2 := murmur3.Sum128(heavy)
+	rows := make(map[int]struct{}, d)
+	for _, cell := range cells {
+		require.Equal(t, int((h1+h2*uint64(cell.Row))%uint64(w)), cell.Col)
+		require.GreaterOrEqual(t, cell.Count, uint32(10000))
+		rows[cell.Row] = struct{}{}
+	}
+	require.Len(t, rows, int(d))
+
+	require.Len(t, cms.HottestCells(int(d*w)+1), int(d*w))
+	require.Nil(t, cms.HottestCells(0))
+}
+
+func TestCMSketchApproxTopK(t *testing.T) {
+	cms := NewCMSketch(5, 2048)
+	candidates := make([][]byte, 0, 20)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		candidates = append(candidates, key)
+		// The count of key{i} is 1000 / (i + 1), which is skewed.
+		cms.InsertBytesByCount(key, uint64(1000/(i+1)))
+	}
+	for i := 0; i < 1000; i++ {
+		cms.InsertBytes([]byte(fmt.Sprintf("light%d", i)))
+	}
+
+	results := cms.ApproxTopK(candidates, 5)
+	require.Len(t, results, 5)
+	for i, result := range results {
+		require.Equal(t, candidates[i], result.Key)
+		require.Equal(t, cms.QueryBytes(result.Key), result.Est)
+	}
+	require.Len(t, cms.ApproxTopK(candidates, 100), len(candidates))
+	require.Nil(t, cms.ApproxTopK(candidates, 0))
+
+	// The candidates with the same estimate are ordered by the key.
+	results = NewCMSketch(5, 2048).ApproxTopK([][]byte{[]byte("c"), []byte("a"), []byte("b")}, 2)
+	require.Len(t, results, 2)
+	require.Equal(t, []byte("a"), results[0].Key)
+	require.Equal(t, []byte("b"), results[1].Key)
+}
+
+func TestCorrelationEstimate(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	keys := make([][]byte, 0, 100)
+	a, b, c := NewCMSketch(d, w), NewCMSketch(d, w), NewCMSketch(d, w)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		keys = append(keys, key)
+		a.InsertBytesByCount(key, uint64(i+1))
+		b.InsertBytesByCount(key, uint64(2*(i+1)))
+		// c only contains the values which are not in a and b.
+		c.InsertBytesByCount([]byte(fmt.Sprintf("other%d", i)), uint64(i+1))
+	}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("other%d", i)))
+	}
+	require.InDelta(t, 1, CorrelationEstimate(a, b, keys, a.TotalCount(), b.TotalCount()), 0.01)
+	require.InDelta(t, 0, CorrelationEstimate(a, c, keys, a.TotalCount(), c.TotalCount()), 0.05)
+	require.Equal(t, float64(0), CorrelationEstimate(a, nil, keys, a.TotalCount(), 0))
+}
+
+func TestDistributionDivergence(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	keys := make([][]byte, 0, 200)
+	a, b, c := NewCMSketch(d, w), NewCMSketch(d, w), NewCMSketch(d, w)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		keys = append(keys, key)
+		a.InsertBytesByCount(key, uint64(i+1))
+		// b has the same distribution as a with the doubled counts.
+		b.InsertBytesByCount(key, uint64(2*(i+1)))
+		// c only contains the values which are not in a and b.
+		c.InsertBytesByCount([]byte(fmt.Sprintf("other%d", i)), uint64(i+1))
+	}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("other%d", i)))
+	}
+	require.InDelta(t, 0, DistributionDivergence(a, a.Copy(), keys), 1e-9)
+	require.InDelta(t, 0, DistributionDivergence(a, b, keys), 0.01)
+	require.InDelta(t, 1, DistributionDivergence(a, c, keys), 0.05)
+	require.Equal(t, DistributionDivergence(a, c, keys), DistributionDivergence(c, a, keys))
+	require.Equal(t, float64(1), DistributionDivergence(a, nil, keys))
+	require.Equal(t, float64(0), DistributionDivergence(nil, NewCMSketch(d, w), keys))
+}
+
+func TestTopNScale(t *testing.T) {
+	topN := NewTopN(3)
+	topN.AppendTopN([]byte("a"), 1)
+	topN.AppendTopN([]byte("b"), 2)
+	topN.AppendTopN([]byte("c"), 3)
+	topN.Scale(10)
+	require.Equal(t, uint64(10), topN.TopN[0].Count)
+	require.Equal(t, uint64(20), topN.TopN[1].Count)
+	require.Equal(t, uint64(30), topN.TopN[2].Count)
+	require.Equal(t, uint64(60), topN.TotalCount())
+
+	topN.Scale(0.25)
+	require.Equal(t, uint64(3), topN.TopN[0].Count)
+	require.Equal(t, uint64(5), topN.TopN[1].Count)
+	require.Equal(t, uint64(8), topN.TopN[2].Count)
+}
+
+func TestTopNCompressedCoding(t *testing.T) {
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	topN := NewTopN(3)
+	for i := 1; i <= 3; i++ {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(1), types.NewIntDatum(int64(i)))
+		require.NoError(t, err)
+		topN.AppendTopN(key, uint64(i*100))
+	}
+	topN.Sort()
+
+	compressed := EncodeTopNCompressed(topN)
+	uncompressed, err := CMSketchToProto(nil, topN).Marshal()
+	require.NoError(t, err)
+	require.Less(t, len(compressed), len(uncompressed))
+
+	decoded, err := DecodeTopNCompressed(compressed)
+	require.NoError(t, err)
+	require.Equal(t, topN.TopN, decoded.TopN)
+
+	_, err = DecodeTopNCompressed(compressed[:len(compressed)-1])
+	require.Error(t, err)
+	decoded, err = DecodeTopNCompressed(EncodeTopNCompressed(nil))
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+}
+
+func TestCMSketchQueryValues(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	keys := make([][]byte, 0, len(mp)+1)
+	for num := range mp {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		keys = append(keys, data)
+	}
+	data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(-1))
+	require.NoError(t, err)
+	keys = append(keys, data)
+
+	results := cms.QueryValues(keys)
+	require.Len(t, results, len(keys))
+	for i, key := range keys {
+		require.Equal(t, cms.QueryBytes(key), results[i])
+	}
+}
+
+func prepareCMSketchQueryKeys(b *testing.B) (*CMSketch, [][]byte) {
+	cms, mp, err := buildCMSketchAndMap(5, 2048, 0, 100000, 1000000, 1.1)
+	require.NoError(b, err)
+	keys := make([][]byte, 0, len(mp))
+	for num := range mp {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(b, err)
+		keys = append(keys, data)
+	}
+	return cms, keys
+}
+
+// cmd: go test -run=^$ -bench=BenchmarkCMSketchQueryValues -benchmem github.com/pingcap/tidb/statistics
+func BenchmarkCMSketchQueryValues(b *testing.B) {
+	cms, keys := prepareCMSketchQueryKeys(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = cms.QueryValues(keys)
+	}
+}
+
+func BenchmarkCMSketchQueryBytesPerKey(b *testing.B) {
+	cms, keys := prepareCMSketchQueryKeys(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			_ = cms.QueryBytes(key)
+		}
+	}
+}
+
+func prepareZipfSample(t require.TestingT, size int, s float64) [][]byte {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(0)), s, 1, 1000000)
+	sample := make([][]byte, 0, size)
+	for i := 0; i < size; i++ {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(int64(zipf.Uint64())))
+		require.NoError(t, err)
+		sample = append(sample, data)
+	}
+	return sample
+}
+
+func TestNewCMSketchAndTopNParallel(t *testing.T) {
+	// Make the values with the same count in the same order, so the TopNs are the same.
+	require.NoError(t, failpoint.Enable("github.com/pingcap/tidb/statistics/StabilizeV1AnalyzeTopN", `return(true)`))
+	defer func() {
+		require.NoError(t, failpoint.Disable("github.com/pingcap/tidb/statistics/StabilizeV1AnalyzeTopN"))
+	}()
+	for _, s := range []float64{1.1, 2} {
+		sample := prepareZipfSample(t, 10000, s)
+		cms, topN, ndv, scaleRatio := NewCMSketchAndTopN(5, 2048, sample, 20, 1000000)
+		for _, concurrency := range []int{1, 2, 4, 7} {
+			pCMS, pTopN, pNDV, pScaleRatio := NewCMSketchAndTopNParallel(5, 2048, sample, 20, 1000000, concurrency)
+			require.True(t, cms.Equal(pCMS), "concurrency: %d", concurrency)
+			require.True(t, topN.Equal(pTopN), "concurrency: %d", concurrency)
+			require.Equal(t, ndv, pNDV)
+			require.Equal(t, scaleRatio, pScaleRatio)
+		}
+	}
+	pCMS, pTopN, _, _ := NewCMSketchAndTopNParallel(5, 2048, nil, 20, 1000000, 4)
+	require.Nil(t, pCMS)
+	require.Nil(t, pTopN)
+}
+
+// cmd: go test -run=^$ -bench=BenchmarkNewCMSketchAndTopN -benchmem github.com/pingcap/tidb/statistics
+func BenchmarkNewCMSketchAndTopN(b *testing.B) {
+	sample := prepareZipfSample(b, 1000000, 1.1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewCMSketchAndTopN(5, 2048, sample, 100, 10000000)
+	}
+}
+
+func BenchmarkNewCMSketchAndTopNParallel4(b *testing.B) {
+	sample := prepareZipfSample(b, 1000000, 1.1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewCMSketchAndTopNParallel(5, 2048, sample, 100, 10000000, 4)
+	}
+}
+
+func TestNotEqualSelectivity(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total := uint64(1000000)
+	vals := make([]*types.Datum, 0, 1000)
+	for i := uint64(0); i < 1000; i++ {
+		val := types.NewIntDatum(int64(i))
+		vals = append(vals, &val)
+	}
+	cms, topN, err := prepareCMSAndTopN(d, w, vals, uint32(20), total)
+	require.NoError(t, err)
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	sel, err := NotEqualSelectivity(sc, cms, topN, total, types.NewIntDatum(1))
+	require.NoError(t, err)
+	require.InDelta(t, 1, sel, 1e-5)
+	require.Less(t, sel, float64(1))
+
+	topN = NewTopN(1)
+	key, err := codec.EncodeValue(sc, nil, types.NewIntDatum(1))
+	require.NoError(t, err)
+	topN.AppendTopN(key, total/4)
+	sel, err = NotEqualSelectivity(sc, nil, topN, total, types.NewIntDatum(1))
+	require.NoError(t, err)
+	require.Equal(t, 0.75, sel)
+	// The estimate is clamped when it's larger than the total count.
+	sel, err = NotEqualSelectivity(sc, nil, topN, total/8, types.NewIntDatum(1))
+	require.NoError(t, err)
+	require.Equal(t, float64(0), sel)
+}
+
+func TestCMSketchRepairCount(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	cms, _, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	require.Equal(t, total, cms.ImpliedCount())
+
+	cms.count = 42
+	// Corrupt one row, the median of the row sums is not affected.
+	cms.table[0][0] += 1000
+	require.Equal(t, total, cms.ImpliedCount())
+	cms.RepairCount()
+	require.Equal(t, total, cms.TotalCount())
+	require.Equal(t, cms.ImpliedCount(), cms.TotalCount())
+}
+
+// prepareTopNForQuery builds a TopN of n random values, every value in the TopN and some missing values are returned
+// as the keys to query, and the oracle maps the values in the TopN to their counts.
+func prepareTopNForQuery(t require.TestingT, n int) (*TopN, [][]byte, map[string]uint64) {
+	r := rand.New(rand.NewSource(0))
+	topN := NewTopN(n)
+	oracle := make(map[string]uint64, n)
+	keys := make([][]byte, 0, 2*n)
+	for len(oracle) < n {
+		key, err := codec.EncodeValue(nil, nil, types.NewIntDatum(r.Int63()))
+		require.NoError(t, err)
+		if _, ok := oracle[string(key)]; ok {
+			continue
+		}
+		count := uint64(r.Intn(1000) + 1)
+		oracle[string(key)] = count
+		topN.AppendTopN(key, count)
+		keys = append(keys, key)
+		missing, err := codec.EncodeValue(nil, nil, types.NewIntDatum(-r.Int63()-1))
+		require.NoError(t, err)
+		keys = append(keys, missing)
+	}
+	topN.Sort()
+	return topN, keys, oracle
+}
+
+func TestTopNQueryTopN(t *testing.T) {
+	for _, n := range []int{0, 1, 20, 1000} {
+		topN, keys, oracle := prepareTopNForQuery(t, n)
+		for _, key := range keys {
+			count, found := topN.QueryTopN(nil, key)
+			expected, ok := oracle[string(key)]
+			require.Equal(t, ok, found)
+			require.Equal(t, expected, count)
+		}
+	}
+}
+
+func benchmarkTopNQueryTopN(n int, b *testing.B) {
+	topN, keys, _ := prepareTopNForQuery(b, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = topN.QueryTopN(nil, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkTopNQueryTopN20(b *testing.B) {
+	benchmarkTopNQueryTopN(20, b)
+}
+
+func BenchmarkTopNQueryTopN1000(b *testing.B) {
+	benchmarkTopNQueryTopN(1000, b)
+}
+
+func BenchmarkTopNQueryTopN100000(b *testing.B) {
+	benchmarkTopNQueryTopN(100000, b)
+}
+
+func TestTopNNormalize(t *testing.T) {
+	topN := NewTopN(4)
+	for _, count := range []uint64{2, 3, 5} {
+		topN.AppendTopN([]byte("a"), count)
+	}
+	topN.AppendTopN([]byte("0"), 1)
+	topN.Normalize()
+	require.Equal(t, []TopNMeta{{Encoded: []byte("0"), Count: 1}, {Encoded: []byte("a"), Count: 10}}, topN.TopN)
+	require.Equal(t, uint64(11), topN.TotalCount())
+
+	// The duplicated entries are counted once by the merging.
+	dup := NewTopN(3)
+	for _, count := range []uint64{2, 3, 5} {
+		dup.AppendTopN([]byte("a"), count)
+	}
+	isKilled := uint32(0)
+	dup.AppendTopN([]byte("0"), 1)
+	origin := slices.Clone(dup.TopN)
+	globalTopN, _, _, err := MergePartTopN2GlobalTopN(time.UTC, 2, []*TopN{dup}, 10, []*Histogram{nil}, false, &isKilled)
+	require.NoError(t, err)
+	require.Equal(t, []TopNMeta{{Encoded: []byte("0"), Count: 1}, {Encoded: []byte("a"), Count: 10}}, globalTopN.TopN)
+	// The input TopN, which may be shared by the stats cache, is not changed by the merging.
+	require.Equal(t, origin, dup.TopN)
+}
+
+func TestTopNPin(t *testing.T) {
+	topN := NewTopN(4)
+	topN.AppendTopN([]byte("a"), 100)
+	topN.AppendTopN([]byte("b"), 1)
+	topN.AppendTopN([]byte("c"), 50)
+	topN.AppendTopN([]byte("d"), 10)
+	topN.Sort()
+	topN.Pin([]byte("b"))
+	require.True(t, topN.IsPinned([]byte("b")))
+	require.False(t, topN.IsPinned([]byte("a")))
+
+	evicted := topN.Truncate(2)
+	require.Equal(t, []TopNMeta{{[]byte("d"), 10}}, evicted)
+	require.Equal(t, []TopNMeta{{[]byte("a"), 100}, {[]byte("b"), 1}, {[]byte("c"), 50}}, topN.TopN)
+
+	// The pinned value survives the merge.
+	other := NewTopN(2)
+	other.AppendTopN([]byte("e"), 70)
+	other.AppendTopN([]byte("f"), 60)
+	merged, left := MergeTopN([]*TopN{topN, other}, 2)
+	require.Equal(t, []TopNMeta{{[]byte("a"), 100}, {[]byte("b"), 1}, {[]byte("e"), 70}}, merged.TopN)
+	require.True(t, merged.IsPinned([]byte("b")))
+	require.Equal(t, []TopNMeta{{[]byte("f"), 60}, {[]byte("c"), 50}}, left)
+	require.True(t, merged.Copy().IsPinned([]byte("b")))
+}
+
+func TestTopNPinNotPersisted(t *testing.T) {
+	topN := NewTopN(2)
+	topN.AppendTopN([]byte("a"), 100)
+	topN.AppendTopN([]byte("b"), 1)
+	topN.Pin([]byte("b"))
+
+	// The pinned value is kept as a normal value after decoding, but it's not pinned anymore.
+	_, protoTopN := CMSketchAndTopNFromProto(CMSketchToProto(nil, topN))
+	data, err := json.Marshal(topN)
+	require.NoError(t, err)
+	jsonTopN := &TopN{}
+	require.NoError(t, json.Unmarshal(data, jsonTopN))
+	compressedTopN, err := DecodeTopNCompressed(EncodeTopNCompressed(topN))
+	require.NoError(t, err)
+	for _, decoded := range []*TopN{protoTopN, jsonTopN, compressedTopN} {
+		require.True(t, topN.Equal(decoded))
+		require.False(t, decoded.IsPinned([]byte("b")))
+		require.Equal(t, []TopNMeta{{[]byte("b"), 1}}, decoded.Truncate(1))
+	}
+}
+
+func TestCMSketchSumEstimateForKeys(t *testing.T) {
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	cms := NewCMSketch(5, 2048)
+	rnd := rand.New(rand.NewSource(0))
+	prefixCount := make(map[int64]uint64)
+	for prefix := int64(0); prefix < 20; prefix++ {
+		for suffix := int64(0); suffix < 5; suffix++ {
+			key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(prefix), types.NewIntDatum(suffix))
+			require.NoError(t, err)
+			count := uint64(1000 + rnd.Intn(1000))
+			cms.InsertBytesByCount(key, count)
+			prefixCount[prefix] += count
+		}
+	}
+
+	for prefix, count := range prefixCount {
+		keys := make([][]byte, 0, 5)
+		for suffix := int64(0); suffix < 5; suffix++ {
+			key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(prefix), types.NewIntDatum(suffix))
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		require.InEpsilon(t, count, cms.SumEstimateForKeys(keys), 0.1)
+	}
+
+	// The sum is saturated at the count.
+	key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(0), types.NewIntDatum(0))
+	require.NoError(t, err)
+	keys := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, key)
+	}
+	require.Equal(t, cms.TotalCount(), cms.SumEstimateForKeys(keys))
+}
+
+func TestCMSketchEstimatedCollisionError(t *testing.T) {
+	// A narrow sketch makes the keys collide.
+	cms := NewCMSketch(2, 4)
+	keys := make([][]byte, 0, 10)
+	trueCounts := make([]uint64, 0, 10)
+	for i := int64(0); i < 10; i++ {
+		key, err := codec.EncodeValue(nil, nil, types.NewIntDatum(i))
+		require.NoError(t, err)
+		count := uint64(i*10 + 1)
+		cms.InsertBytesByCount(key, count)
+		keys = append(keys, key)
+		trueCounts = append(trueCounts, count)
+	}
+	expected := uint64(0)
+	for i, key := range keys {
+		if estimate := cms.QueryBytes(key); estimate > trueCounts[i] {
+			expected += estimate - trueCounts[i]
+		}
+	}
+	collisionError, err := cms.EstimatedCollisionError(keys, trueCounts)
+	require.NoError(t, err)
+	require.Equal(t, expected, collisionError)
+	require.Greater(t, collisionError, uint64(0))
+
+	_, err = cms.EstimatedCollisionError(keys, trueCounts[1:])
+	require.Error(t, err)
+}
+
+func TestCMSketchQueryIntRangeSum(t *testing.T) {
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	// All the values of the zipf generator are in [0, 100], so the range is dense.
+	cms, mp, err := buildCMSketchAndMap(5, 2048, 0, 10000, 100, 1.1)
+	require.NoError(t, err)
+	for _, r := range [][2]int64{{0, 0}, {0, 10}, {5, 50}, {0, 100}} {
+		expected := uint64(0)
+		for v := r[0]; v <= r[1]; v++ {
+			expected += uint64(mp[v])
+		}
+		estimate, err := cms.QueryIntRangeSum(sc, r[0], r[1])
+		require.NoError(t, err)
+		require.InEpsilon(t, expected, estimate, 0.1, "range: %v", r)
+	}
+	estimate, err := cms.QueryIntRangeSum(sc, 10, 5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), estimate)
+
+	_, err = cms.QueryIntRangeSum(sc, 0, MaxCMSketchIntRangeWidth.Load())
+	require.Error(t, err)
+	_, err = cms.QueryIntRangeSum(sc, math.MinInt64, math.MaxInt64)
+	require.Error(t, err)
+}
+
+func TestCMSketchInsertDatum(t *testing.T) {
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	cms := NewCMSketch(5, 2048)
+	mp := make(map[string]uint64)
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		var d types.Datum
+		if i%2 == 0 {
+			d = types.NewFloat64Datum(float64(rnd.Intn(100)) / 4)
+		} else {
+			d = types.NewDecimalDatum(types.NewDecFromInt(int64(rnd.Intn(100))))
+		}
+		require.NoError(t, cms.InsertDatum(sc, &d))
+		key, err := codec.EncodeKey(sc, nil, d)
+		require.NoError(t, err)
+		mp[string(key)]++
+	}
+	var totalError uint64
+	for key, count := range mp {
+		// The counters are never less than the count, and the estimation eliminates the noise of the collisions.
+		for _, counter := range cms.RowEstimates([]byte(key)) {
+			require.GreaterOrEqual(t, uint64(counter), count)
+		}
+		estimate := cms.QueryBytes([]byte(key))
+		totalError += mathutil.Max(estimate, count) - mathutil.Min(estimate, count)
+	}
+	require.LessOrEqual(t, totalError/uint64(len(mp)), uint64(10))
+
+	// The decimals equal in value are encoded to the same bytes.
+	d1, d2 := types.NewDecimalDatum(types.NewDecFromStringForTest("1.5")), types.NewDecimalDatum(types.NewDecFromStringForTest("1.50"))
+	key1, err := codec.EncodeKey(sc, nil, d1)
+	require.NoError(t, err)
+	key2, err := codec.EncodeKey(sc, nil, d2)
+	require.NoError(t, err)
+	require.Equal(t, key1, key2)
+	// The keys keep the order of the values.
+	f1, f2 := types.NewFloat64Datum(-1.5), types.NewFloat64Datum(0.25)
+	key1, err = codec.EncodeKey(sc, nil, f1)
+	require.NoError(t, err)
+	key2, err = codec.EncodeKey(sc, nil, f2)
+	require.NoError(t, err)
+	require.Negative(t, bytes.Compare(key1, key2))
+}
+
+func TestCMSketchApproxKeyCount(t *testing.T) {
+	cms := NewCMSketch(5, 8192)
+	require.Equal(t, int64(0), cms.ApproxKeyCount())
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		// The duplicated inserts don't affect the estimation.
+		cms.InsertBytesByCount(key, uint64(i%10+1))
+	}
+	require.Greater(t, cms.TotalCount(), uint64(2000))
+	require.InEpsilon(t, 2000, cms.ApproxKeyCount(), 0.05)
+
+	// The estimation never exceeds the count.
+	cms = NewCMSketch(5, 8)
+	for i := 0; i < 4; i++ {
+		cms.InsertBytes([]byte(fmt.Sprintf("key%d", i)))
+	}
+	require.LessOrEqual(t, cms.ApproxKeyCount(), int64(4))
+}
+
+func TestVersionedCMSketch(t *testing.T) {
+	d, w := int32(5), int32(64)
+	newSketch := func(v uint32) *CMSketch {
+		cms := NewCMSketch(d, w)
+		for i := range cms.table {
+			for j := range cms.table[i] {
+				cms.table[i][j] = v
+			}
+		}
+		cms.count = uint64(v) * uint64(w)
+		return cms
+	}
+	versioned := NewVersionedCMSketch(newSketch(0))
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				cms := versioned.Load()
+				v := cms.table[0][0]
+				// All the counters of a snapshot are the same.
+				for i := range cms.table {
+					for j := range cms.table[i] {
+						if cms.table[i][j] != v {
+							t.Errorf("inconsistent counter %d, expect %d", cms.table[i][j], v)
+							return
+						}
+					}
+				}
+				if cms.count != uint64(v)*uint64(w) {
+					t.Errorf("inconsistent count %d, expect %d", cms.count, uint64(v)*uint64(w))
+					return
+				}
+			}
+		}()
+	}
+	for v := uint32(1); v <= 1000; v++ {
+		cms := versioned.Load().Copy()
+		for i := range cms.table {
+			for j := range cms.table[i] {
+				cms.table[i][j] = v
+			}
+		}
+		cms.count = uint64(v) * uint64(w)
+		versioned.Store(cms)
+	}
+	stop.Store(true)
+	wg.Wait()
+	require.True(t, newSketch(1000).Equal(versioned.Load()))
+}
+
+// cmd: go test -run=^$ -bench=BenchmarkCMSketchInsert -benchmem github.com/pingcap/tidb/statistics
+func BenchmarkCMSketchInsert(b *testing.B) {
+	keys := make([][]byte, 0, 1000000)
+	for i := int64(0); i < 1000000; i++ {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(i))
+		require.NoError(b, err)
+		keys = append(keys, data)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cms := NewCMSketch(5, 2048)
+		for _, key := range keys {
+			cms.InsertBytes(key)
+		}
+	}
+}
+
+// cmd: go test -run=^$ -bench=BenchmarkCMSketchQuery -benchmem github.com/pingcap/tidb/statistics
+func BenchmarkCMSketchQuery(b *testing.B) {
+	cms, _ := prepareCMSketchQueryKeys(b)
+	// The data follows the zipf distribution, so the smallest values are the hottest keys.
+	hotKeys := make([][]byte, 0, 100)
+	for i := int64(0); i < 100; i++ {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(i))
+		require.NoError(b, err)
+		hotKeys = append(hotKeys, data)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range hotKeys {
+			_ = cms.QueryBytes(key)
+		}
+	}
+}
+
+func TestEstimateTransformed(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	// The values are days, 10 days for each `year`, and the first days are the most frequent.
+	vals := make([]*types.Datum, 0, 10000)
+	counts := make(map[int64]uint64)
+	for day := int64(0); day < 100; day++ {
+		repeat := 10
+		if day%10 == 0 {
+			repeat = 200
+		}
+		for i := 0; i < repeat; i++ {
+			val := types.NewIntDatum(day)
+			vals = append(vals, &val)
+		}
+		counts[day/10] += uint64(repeat)
+	}
+	cms, topN, err := prepareCMSAndTopN(d, w, vals, uint32(5), uint64(len(vals)))
+	require.NoError(t, err)
+	require.NotEmpty(t, topN.TopN)
+
+	for year, count := range counts {
+		keys := make([][]byte, 0, 10)
+		for day := year * 10; day < (year+1)*10; day++ {
+			key, err := codec.EncodeValue(nil, nil, types.NewIntDatum(day))
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		require.InEpsilon(t, count, EstimateTransformed(cms, topN, keys), 0.1)
+	}
+	require.Equal(t, uint64(0), EstimateTransformed(cms, topN, nil))
+	require.Equal(t, uint64(0), EstimateTransformed(nil, nil, [][]byte{{1}}))
+}
+
+func TestCMSketchCompactDepth(t *testing.T) {
+	d, w := int32(6), int32(128)
+	total, imax := uint64(10000), uint64(1000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+
+	compacted, err := cms.CompactDepth(3)
+	require.NoError(t, err)
+	width, depth := compacted.GetWidthAndDepth()
+	require.Equal(t, w, width)
+	require.Equal(t, int32(3), depth)
+	require.Equal(t, cms.TotalCount(), compacted.TotalCount())
+	for num, count := range mp {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		h1, h2 := murmur3.Sum128(data)
+		// Every row of the compacted sketch still counts all the occurrences of the key.
+		for i := range compacted.table {
+			j := (h1 + h2*uint64(i)) % uint64(w)
+			require.GreaterOrEqual(t, compacted.table[i][j], count)
+		}
+	}
+	// The original sketch is not changed.
+	_, depth = cms.GetWidthAndDepth()
+	require.Equal(t, d, depth)
+
+	_, err = cms.CompactDepth(4)
+	require.Error(t, err)
+	_, err = cms.CompactDepth(0)
+	require.Error(t, err)
+	_, err = cms.CompactDepth(12)
+	require.Error(t, err)
+}
+
+func TestTopNSortByCount(t *testing.T) {
+	topN := NewTopN(4)
+	topN.AppendTopN([]byte("a"), 1)
+	topN.AppendTopN([]byte("b"), 3)
+	topN.AppendTopN([]byte("c"), 2)
+	topN.AppendTopN([]byte("d"), 3)
+	require.False(t, topN.IsSortedByCount())
+
+	topN.SortByCount()
+	require.True(t, topN.IsSortedByCount())
+	encoded := make([]string, 0, len(topN.TopN))
+	for _, meta := range topN.TopN {
+		encoded = append(encoded, string(meta.Encoded))
+	}
+	require.Equal(t, []string{"b", "d", "c", "a"}, encoded)
+
+	topN.Sort()
+	require.False(t, topN.IsSortedByCount())
+	count, ok := topN.QueryTopN(nil, []byte("c"))
+	require.True(t, ok)
+	require.Equal(t, uint64(2), count)
+
+	var nilTopN *TopN
+	require.True(t, nilTopN.IsSortedByCount())
+}
+
+func TestHybridCMSketch(t *testing.T) {
+	d, w := int32(5), int32(256)
+	threshold := uint64(10)
+	plain := NewCMSketch(d, w)
+	hybrid := NewHybridCMSketch(d, w, threshold, 100000)
+	mp := make(map[int64]uint64)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(0)), 2, 1, 100000)
+	for i := 0; i < 100000; i++ {
+		num := int64(zipf.Uint64())
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		plain.InsertBytes(data)
+		hybrid.InsertBytes(data)
+		mp[num]++
+	}
+
+	var plainErr, hybridErr float64
+	for num, count := range mp {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		if count < threshold {
+			// The tail keys are counted exactly.
+			require.Equal(t, count, hybrid.QueryValue(data))
+			plainErr += math.Abs(float64(plain.QueryBytes(data)) - float64(count))
+			hybridErr += math.Abs(float64(hybrid.QueryValue(data)) - float64(count))
+		} else {
+			// The spilled keys keep all their occurrences in the CMSketch.
+			h1, h2 := murmur3.Sum128(data)
+			cms := hybrid.CMSketch()
+			for i := range cms.table {
+				require.GreaterOrEqual(t, uint64(cms.table[i][(h1+h2*uint64(i))%uint64(w)]), count)
+			}
+		}
+	}
+	require.Less(t, hybridErr, plainErr)
+
+	// The keys beyond the bound go to the CMSketch directly.
+	bounded := NewHybridCMSketch(d, w, threshold, 1)
+	bounded.InsertBytes([]byte("a"))
+	bounded.InsertBytes([]byte("b"))
+	require.Equal(t, uint64(1), bounded.QueryValue([]byte("a")))
+	require.Equal(t, uint64(1), bounded.CMSketch().TotalCount())
+
+	// The occurrences after spilling go to the CMSketch, so the estimate includes the spilled ones.
+	spilled := NewHybridCMSketch(d, 2048, threshold, 100)
+	for i := uint64(0); i < threshold+1; i++ {
+		spilled.InsertBytes([]byte("a"))
+	}
+	require.Equal(t, threshold+1, spilled.QueryValue([]byte("a")))
+	require.Equal(t, threshold+1, spilled.CMSketch().TotalCount())
+
+	// The key inserted to the CMSketch when the exact counts are full is not counted exactly after some keys spilled.
+	full := NewHybridCMSketch(d, 2048, 2, 1)
+	full.InsertBytes([]byte("a"))
+	full.InsertBytes([]byte("b"))
+	full.InsertBytes([]byte("a"))
+	full.InsertBytes([]byte("b"))
+	require.Equal(t, uint64(2), full.QueryValue([]byte("a")))
+	require.Equal(t, uint64(2), full.QueryValue([]byte("b")))
+
+	// The spilled keys are bounded too, once they are full, the new keys go to the CMSketch directly.
+	capped := NewHybridCMSketch(d, 2048, 2, 2)
+	for _, key := range []string{"a", "a", "b", "b", "c", "c", "c", "d"} {
+		capped.InsertBytes([]byte(key))
+	}
+	require.Len(t, capped.spilled, 2)
+	require.Empty(t, capped.exact)
+	require.Equal(t, uint64(3), capped.QueryValue([]byte("c")))
+	require.Equal(t, uint64(1), capped.QueryValue([]byte("d")))
+	require.Equal(t, uint64(8), capped.CMSketch().TotalCount())
+}
+
+func TestEstimateLeftTopNSize(t *testing.T) {
+	loc := time.UTC
+	version := 2
+	isKilled := uint32(0)
+	topNs := make([]*TopN, 0, 4)
+	for i := 0; i < 4; i++ {
+		// The adjacent TopNs share 5 values, 25 distinct values in total.
+		topN := NewTopN(10)
+		for j := i * 5; j < i*5+10; j++ {
+			topN.AppendTopN([]byte(fmt.Sprintf("%02d", j)), uint64(j+1))
+		}
+		topNs = append(topNs, topN)
+	}
+	topNs = append(topNs, NewTopN(0), nil)
+	// The empty histograms don't contain any value.
+	hists := make([]*Histogram, len(topNs))
+	for _, n := range []int{0, 10, 25, 30} {
+		_, leftTopN, _, err := MergePartTopN2GlobalTopN(loc, version, topNs, uint32(n), hists, true, &isKilled)
+		require.NoError(t, err)
+		require.Equal(t, len(leftTopN), EstimateLeftTopNSize(topNs, n))
+	}
+	require.Equal(t, 15, EstimateLeftTopNSize(topNs, 10))
+}
+
+func TestFloatCMSketch(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	weights := map[string]float64{"a": 0.5, "b": 2.25, "c": 10}
+	cms := NewFloatCMSketch(d, w)
+	for key, weight := range weights {
+		// Every key is inserted 4 times.
+		for i := 0; i < 4; i++ {
+			cms.InsertWeighted([]byte(key), weight)
+		}
+	}
+	require.InDelta(t, 51, cms.TotalCount(), 1e-9)
+	for key, weight := range weights {
+		require.InDelta(t, 4*weight, cms.QueryValue([]byte(key)), 1e-9)
+	}
+	require.InDelta(t, 0, cms.QueryValue([]byte("d")), 1e-9)
+
+	// With all the weights being 1, it is the same as the CMSketch.
+	total, imax := uint64(10000), uint64(1000)
+	intCMS := NewCMSketch(d, w)
+	floatCMS := NewFloatCMSketch(d, w)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(0)), 1.1, 1, imax)
+	for i := uint64(0); i < total; i++ {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(int64(zipf.Uint64())))
+		require.NoError(t, err)
+		intCMS.InsertBytes(data)
+		floatCMS.InsertWeighted(data, 1)
+	}
+	require.Equal(t, float64(intCMS.TotalCount()), floatCMS.TotalCount())
+	for i := range intCMS.table {
+		for j := range intCMS.table[i] {
+			require.Equal(t, float64(intCMS.table[i][j]), floatCMS.table[i][j])
+		}
+	}
+}
+
+func TestMergePartTopN2GlobalTopNWithOverlappedValues(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	version := 2
+	isKilled := uint32(0)
+	encode := func(v int64) []byte {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(v))
+		require.NoError(t, err)
+		return key
+	}
+
+	// The values 1 to 5 are in all the TopNs, the value 6 is only in the first TopN and in the other histograms.
+	topNs := make([]*TopN, 0, 10)
+	hists := make([]*Histogram, 0, 10)
+	for i := 0; i < 10; i++ {
+		topN := NewTopN(6)
+		for v := int64(1); v <= 5; v++ {
+			topN.AppendTopN(encode(v), 20)
+		}
+		h := NewHistogram(1, 1, 0, 0, types.NewFieldType(mysql.TypeBlob), chunk.InitialCapacity, 0)
+		if i == 0 {
+			topN.AppendTopN(encode(6), 100)
+			d := types.NewBytesDatum(encode(7))
+			h.AppendBucketWithNDV(&d, &d, 5, 5, 1)
+		} else {
+			d := types.NewBytesDatum(encode(6))
+			h.AppendBucketWithNDV(&d, &d, 7, 7, 1)
+		}
+		topN.Sort()
+		topNs = append(topNs, topN)
+		hists = append(hists, h)
+	}
+
+	globalTopN, leftTopN, hists, err := MergePartTopN2GlobalTopN(loc, version, topNs, 3, hists, true, &isKilled)
+	require.NoError(t, err)
+	// Every overlapped value is counted once per partition, and the value 6 moved from the histograms is
+	// not counted in them anymore.
+	count, ok := globalTopN.QueryTopN(nil, encode(6))
+	require.True(t, ok)
+	require.Equal(t, uint64(163), count)
+	leftCount := uint64(0)
+	for _, meta := range leftTopN {
+		require.Equal(t, uint64(200), meta.Count)
+		leftCount += meta.Count
+	}
+	require.Len(t, leftTopN, 3)
+	require.Equal(t, uint64(5*200+163), globalTopN.TotalCount()+leftCount)
+	histCount := 0.0
+	for _, h := range hists {
+		histCount += h.TotalRowCount()
+	}
+	require.Equal(t, 5.0, histCount)
+}
+
+func TestMergePartTopN2GlobalTopNOrderIndependent(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	version := 2
+	isKilled := uint32(0)
+	encode := func(v int64) []byte {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(v))
+		require.NoError(t, err)
+		return key
+	}
+	// The values 1 and 2 tie in every partition, and the histograms return the fractional counts for the values 3 to 5.
+	buildPartition := func(i int) (*TopN, *Histogram) {
+		topN := NewTopN(3)
+		topN.AppendTopN(encode(1), 10)
+		topN.AppendTopN(encode(2), 10)
+		topN.AppendTopN(encode(int64(3+i%3)), uint64(5+i))
+		topN.Sort()
+		h := NewHistogram(1, 4, 0, 0, types.NewFieldType(mysql.TypeBlob), chunk.InitialCapacity, 0)
+		lower, upper := types.NewBytesDatum(encode(3)), types.NewBytesDatum(encode(8))
+		h.AppendBucketWithNDV(&lower, &upper, int64(10+i), 1, 4)
+		return topN, h
+	}
+	merge := func(order []int) (*TopN, []TopNMeta) {
+		topNs := make([]*TopN, 0, len(order))
+		hists := make([]*Histogram, 0, len(order))
+		for _, i := range order {
+			topN, h := buildPartition(i)
+			topNs = append(topNs, topN)
+			hists = append(hists, h)
+		}
+		globalTopN, leftTopN, _, err := MergePartTopN2GlobalTopN(loc, version, topNs, 3, hists, true, &isKilled)
+		require.NoError(t, err)
+		return globalTopN, leftTopN
+	}
+
+	globalTopN, leftTopN := merge([]int{0, 1, 2, 3, 4, 5})
+	require.Len(t, globalTopN.TopN, 3)
+	require.Len(t, leftTopN, 2)
+	for _, order := range [][]int{{5, 4, 3, 2, 1, 0}, {3, 0, 5, 1, 4, 2}} {
+		otherGlobalTopN, otherLeftTopN := merge(order)
+		require.True(t, globalTopN.Equal(otherGlobalTopN))
+		require.Equal(t, leftTopN, otherLeftTopN)
+	}
+}
+
+func TestCMSketchQueryValueWithConfidence(t *testing.T) {
+	cms := NewCMSketch(5, 64)
+	for i := 0; i < 1000; i++ {
+		cms.InsertBytes([]byte(fmt.Sprintf("key%d", i)))
+	}
+	clean := []byte("clean")
+	cms.InsertBytesByCount(clean, 1000)
+
+	estimate, cleanConfidence := cms.QueryValueWithConfidence(clean)
+	require.Equal(t, cms.QueryBytes(clean), estimate)
+	require.Greater(t, cleanConfidence, 0.9)
+	require.LessOrEqual(t, cleanConfidence, 1.0)
+
+	// The counters of the key inserted once are dominated by the collisions.
+	estimate, collidedConfidence := cms.QueryValueWithConfidence([]byte("key0"))
+	require.Equal(t, cms.QueryBytes([]byte("key0")), estimate)
+	require.Less(t, collidedConfidence, cleanConfidence)
+
+	_, confidence := NewCMSketch(5, 64).QueryValueWithConfidence(clean)
+	require.Equal(t, 1.0, confidence)
+}
+
+func TestMergePartTopN2GlobalTopNWithThreshold(t *testing.T) {
+	loc := time.UTC
+	version := 2
+	isKilled := uint32(0)
+	topNs := make([]*TopN, 0, 4)
+	for i := 0; i < 4; i++ {
+		topN := NewTopN(10)
+		topN.AppendTopN([]byte("a"), 50)
+		topN.AppendTopN([]byte("b"), 30)
+		for c := 'c'; c <= 'j'; c++ {
+			topN.AppendTopN([]byte{byte(c)}, 1)
+		}
+		topNs = append(topNs, topN)
+	}
+	hists := make([]*Histogram, len(topNs))
+
+	// The total count is 352, only a(200) and b(120) exceed 10% of it.
+	globalTopN, leftTopN, _, err := MergePartTopN2GlobalTopNWithThreshold(loc, version, topNs, 10, hists, true, &isKilled, 0.1)
+	require.NoError(t, err)
+	require.Len(t, globalTopN.TopN, 2)
+	require.Equal(t, []byte("a"), globalTopN.TopN[0].Encoded)
+	require.Equal(t, []byte("b"), globalTopN.TopN[1].Encoded)
+	require.Equal(t, uint64(320), globalTopN.TotalCount())
+	require.Len(t, leftTopN, 8)
+	for _, meta := range leftTopN {
+		require.Equal(t, uint64(4), meta.Count)
+	}
+
+	// The size of the global TopN is still capped by n.
+	globalTopN, leftTopN, _, err = MergePartTopN2GlobalTopNWithThreshold(loc, version, topNs, 1, hists, true, &isKilled, 0.1)
+	require.NoError(t, err)
+	require.Len(t, globalTopN.TopN, 1)
+	require.Equal(t, []byte("a"), globalTopN.TopN[0].Encoded)
+	require.Len(t, leftTopN, 9)
+	require.Equal(t, []byte("b"), leftTopN[0].Encoded)
+}
+
+func TestCMSketchMergeInto(t *testing.T) {
+	d := int32(5)
+	total, imax := uint64(100000), uint64(1000000)
+	lSketch, lMap, err := buildCMSketchAndMap(d, 2048, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	rSketch, rMap, err := buildCMSketchAndMap(d, 4096, 1, total, imax, 1.1)
+	require.NoError(t, err)
+	// The same data of rSketch built with the width of lSketch.
+	expected, _, err := buildCMSketchAndMap(d, 2048, 1, total, imax, 1.1)
+	require.NoError(t, err)
+	require.NoError(t, expected.MergeCMSketch(lSketch))
+
+	require.NoError(t, lSketch.MergeInto(rSketch))
+	require.True(t, expected.Equal(lSketch))
+	for num, count := range rMap {
+		lMap[num] += count
+	}
+	avg, err := averageAbsoluteError(lSketch, nil, lMap)
+	require.NoError(t, err)
+	require.Less(t, avg, uint64(6))
+
+	narrow := NewCMSketch(d, 1024)
+	require.Error(t, NewCMSketch(d, 1000).MergeInto(narrow))
+	require.Error(t, NewCMSketch(d, 2048).MergeInto(narrow))
+}
+
+func TestCMSketchMergeWithRescale(t *testing.T) {
+	d := int32(5)
+	total, imax := uint64(100000), uint64(1000000)
+	wide, mp, err := buildCMSketchAndMap(d, 2048, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	narrow, narrowMap, err := buildCMSketchAndMap(d, 1024, 1, total, imax, 1.1)
+	require.NoError(t, err)
+	wide.SetDefaultValue(1)
+	narrow.SetDefaultValue(2)
+	for num, count := range narrowMap {
+		mp[num] += count
+	}
+	// The same data merged by the sketches with the same width.
+	native, _, err := buildCMSketchAndMap(d, 2048, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	other, _, err := buildCMSketchAndMap(d, 2048, 1, total, imax, 1.1)
+	require.NoError(t, err)
+	require.NoError(t, native.MergeCMSketch(other))
+	nativeAvg, err := averageAbsoluteError(native, nil, mp)
+	require.NoError(t, err)
+
+	// The wider sketch is folded no matter which side it is.
+	merged := wide.Copy()
+	require.NoError(t, merged.MergeCMSketchWithRescale(narrow))
+	width, depth := merged.GetWidthAndDepth()
+	require.Equal(t, int32(1024), width)
+	require.Equal(t, d, depth)
+	require.Equal(t, 2*total, merged.TotalCount())
+	require.Equal(t, uint64(3), merged.DefaultValue())
+	reversed := narrow.Copy()
+	require.NoError(t, reversed.MergeCMSketchWithRescale(wide))
+	require.True(t, merged.Equal(reversed))
+
+	merged.SetDefaultValue(0)
+	avg, err := averageAbsoluteError(merged, nil, mp)
+	require.NoError(t, err)
+	require.LessOrEqual(t, avg, 2*nativeAvg)
+
+	require.Error(t, narrow.MergeCMSketchWithRescale(NewCMSketch(d+1, 1024)))
+	require.Error(t, narrow.MergeCMSketchWithRescale(NewCMSketch(d, 1000)))
+	width, _ = narrow.GetWidthAndDepth()
+	require.Equal(t, int32(1024), width)
+}
+
+func TestMassSymmetricDifference(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(10000), uint64(1000)
+	a, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	keys := make([][]byte, 0, len(mp))
+	for num := range mp {
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		keys = append(keys, data)
+	}
+
+	diff, err := MassSymmetricDifference(a, a.Copy(), keys)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), diff)
+
+	// The distribution shifted by 1000 shares no value with the original one.
+	shifted, _, err := buildCMSketchAndMapWithOffset(d, w, 0, total, imax, 1.1, 1000)
+	require.NoError(t, err)
+	diff, err = MassSymmetricDifference(a, shifted, keys)
+	require.NoError(t, err)
+	require.Greater(t, diff, total/2)
+
+	_, err = MassSymmetricDifference(a, NewCMSketch(d, w/2), keys)
+	require.Error(t, err)
+}
+
+func TestTopNUpsert(t *testing.T) {
+	topN := NewTopN(3)
+	topN.UpsertTopN([]byte("b"), 2)
+	topN.UpsertTopN([]byte("a"), 1)
+	topN.UpsertTopN([]byte("b"), 3)
+	topN.UpsertTopN([]byte("c"), 4)
+	require.Len(t, topN.TopN, 3)
+	for i, encoded := range []string{"a", "b", "c"} {
+		require.Equal(t, encoded, string(topN.TopN[i].Encoded))
+	}
+	count, ok := topN.QueryTopN(nil, []byte("b"))
+	require.True(t, ok)
+	require.Equal(t, uint64(5), count)
+	require.Equal(t, uint64(10), topN.TotalCount())
+	_, ok = topN.QueryTopN(nil, []byte("d"))
+	require.False(t, ok)
+}
+
+func TestQueryValuePrefersTopN(t *testing.T) {
+	val := types.NewIntDatum(1)
+	data, err := codec.EncodeValue(nil, nil, val)
+	require.NoError(t, err)
+	cms := NewCMSketch(5, 2048)
+	// The sketch overestimates the value which is also in the TopN.
+	cms.InsertBytesByCount(data, 100)
+	topN := NewTopN(1)
+	topN.AppendTopN(data, 10)
+	require.Equal(t, uint64(100), cms.QueryBytes(data))
+
+	count, err := queryValue(nil, cms, topN, val)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), count)
+
+	count, err = queryValue(nil, cms, nil, val)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), count)
+}
+
+func TestSafeQueryValue(t *testing.T) {
+	data, missed := []byte("a"), []byte("b")
+	// All nil, the estimate is based on the row count only.
+	require.Equal(t, uint64(250), SafeQueryValue(nil, nil, 0.25, 1000, data))
+	require.Equal(t, uint64(0), SafeQueryValue(nil, nil, 0.25, 0, data))
+
+	// TopN only.
+	topN := NewTopN(1)
+	topN.AppendTopN(data, 10)
+	require.Equal(t, uint64(10), SafeQueryValue(nil, topN, 0.25, 1000, data))
+	require.Equal(t, uint64(0), SafeQueryValue(nil, topN, 0.25, 1000, missed))
+
+	// CMSketch only.
+	cms := NewCMSketch(5, 2048)
+	cms.InsertBytesByCount(data, 100)
+	require.Equal(t, uint64(100), SafeQueryValue(cms, nil, 0.25, 1000, data))
+	require.Equal(t, cms.QueryBytes(missed), SafeQueryValue(cms, nil, 0.25, 1000, missed))
+
+	// The TopN is preferred.
+	require.Equal(t, uint64(10), SafeQueryValue(cms, topN, 0.25, 1000, data))
+}
+
+func TestCMSketchApplyLaplaceNoise(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+
+	noisy := cms.Copy()
+	noisy.ApplyLaplaceNoise(0.1, rand.New(rand.NewSource(0)))
+	require.False(t, cms.Equal(noisy))
+	require.Equal(t, cms.TotalCount(), noisy.TotalCount())
+
+	// The large epsilon keeps the estimations of the frequent values roughly the same.
+	noisy = cms.Copy()
+	noisy.ApplyLaplaceNoise(100, rand.New(rand.NewSource(0)))
+	for num, count := range mp {
+		if count < 100 {
+			continue
+		}
+		data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(num))
+		require.NoError(t, err)
+		require.InEpsilon(t, cms.QueryBytes(data), noisy.QueryBytes(data), 0.1)
+	}
+}
+
+func TestTopNToMap(t *testing.T) {
+	m := map[string]uint64{"a": 3, "b": 1, "c": 2}
+	topN := NewTopNFromMap(m, 3)
+	require.Equal(t, 3, topN.Num())
+	count, ok := topN.QueryTopN(nil, []byte("c"))
+	require.True(t, ok)
+	require.Equal(t, uint64(2), count)
+	require.Equal(t, m, topN.ToMap())
+
+	// Only the most frequent values are kept.
+	require.Equal(t, map[string]uint64{"a": 3, "c": 2}, NewTopNFromMap(m, 2).ToMap())
+
+	var nilTopN *TopN
+	require.Empty(t, nilTopN.ToMap())
+	require.NotNil(t, nilTopN.ToMap())
+}
+
+func TestMergeEncodedCMSketches(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(10000), uint64(1000)
+	encoded := make([][]byte, 0, 4)
+	var expected *CMSketch
+	for seed := int64(0); seed < 3; seed++ {
+		cms, _, err := buildCMSketchAndMap(d, w, seed, total, imax, 1.1)
+		require.NoError(t, err)
+		data, err := EncodeCMSketchWithoutTopN(cms)
+		require.NoError(t, err)
+		encoded = append(encoded, data)
+		decoded, _, err := DecodeCMSketchAndTopN(data, nil)
+		require.NoError(t, err)
+		if expected == nil {
+			expected = decoded
+		} else {
+			require.NoError(t, expected.MergeCMSketch(decoded))
+		}
+	}
+	// The empty sketch is skipped.
+	encoded = append(encoded, nil)
+
+	data, err := MergeEncodedCMSketches(encoded)
+	require.NoError(t, err)
+	merged, _, err := DecodeCMSketchAndTopN(data, nil)
+	require.NoError(t, err)
+	require.True(t, expected.Equal(merged))
+
+	data, err = MergeEncodedCMSketches(nil)
+	require.NoError(t, err)
+	require.Nil(t, data)
+
+	narrow, err := EncodeCMSketchWithoutTopN(NewCMSketch(d, w/2))
+	require.NoError(t, err)
+	_, err = MergeEncodedCMSketches(append(encoded, narrow))
+	require.Error(t, err)
+}
+
+func TestCMSketchTableView(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	cms, _, err := buildCMSketchAndMap(d, w, 0, 10000, 1000, 1.1)
+	require.NoError(t, err)
+
+	view := cms.TableView()
+	require.Len(t, view, int(d))
+	restored, err := RestoreCMSketch(d, w, cms.TotalCount(), view)
+	require.NoError(t, err)
+	require.True(t, cms.Equal(restored))
+	// The restored sketch doesn't alias the view.
+	restored.InsertBytes([]byte("a"))
+	require.False(t, cms.Equal(restored))
+
+	_, err = RestoreCMSketch(d+1, w, cms.TotalCount(), view)
+	require.Error(t, err)
+	_, err = RestoreCMSketch(d, w+1, cms.TotalCount(), view)
+	require.Error(t, err)
+	_, err = RestoreCMSketch(0, w, 0, nil)
+	require.Error(t, err)
+}
+
+func TestCMSketchQueryValueSaturated(t *testing.T) {
+	saturated := NewCMSketch(5, 2048)
+	saturated.count = 2048 * math.MaxUint32
+	for i := range saturated.table {
+		for j := range saturated.table[i] {
+			saturated.table[i][j] = math.MaxUint32
+		}
+	}
+	_, ok := saturated.QueryValueSaturated([]byte("a"))
+	require.True(t, ok)
+
+	cms, _, err := buildCMSketchAndMap(5, 2048, 0, 10000, 1000, 1.1)
+	require.NoError(t, err)
+	data, err := codec.EncodeValue(nil, nil, types.NewIntDatum(1))
+	require.NoError(t, err)
+	estimate, ok := cms.QueryValueSaturated(data)
+	require.False(t, ok)
+	require.Equal(t, cms.QueryBytes(data), estimate)
+}
+
+func TestCMSketchMemUsage(t *testing.T) {
+	cms := NewCMSketch(5, 2048)
+	width, depth := cms.GetWidthAndDepth()
+	require.Equal(t, int32(2048), width)
+	require.Equal(t, int32(5), depth)
+	// The counters dominate the memory usage, the slice headers and the metadata are small.
+	require.InDelta(t, 5*2048*4, cms.MemUsage(), 512)
+	require.Greater(t, cms.MemUsage(), int64(5*2048*4))
+	require.Equal(t, EmptyCMSketchSize+5*cmSketchRowHeaderSize+cms.MemoryUsage(), cms.MemUsage())
+	require.Equal(t, int64(0), (*CMSketch)(nil).MemUsage())
+
+	topN := &TopN{TopN: []TopNMeta{
+		{Encoded: []byte("a"), Count: 10},
+		{Encoded: []byte("abc"), Count: 5},
+	}}
+	require.Equal(t, int64(1+8+3+8), topN.MemUsage())
+	require.Equal(t, int64(0), (*TopN)(nil).MemUsage())
+}
+
+func TestCMSketchSaturatedCounters(t *testing.T) {
+	saturated := NewCMSketch(5, 2048)
+	saturated.count = 2048 * math.MaxUint32
+	for i := range saturated.table {
+		for j := range saturated.table[i] {
+			saturated.table[i][j] = math.MaxUint32
+		}
+	}
+	count, fraction := saturated.SaturatedCounters()
+	require.Equal(t, 5*2048, count)
+	require.Equal(t, 1.0, fraction)
+
+	require.NoError(t, saturated.SetCell(0, 0, 0))
+	count, fraction = saturated.SaturatedCounters()
+	require.Equal(t, 5*2048-1, count)
+	require.InDelta(t, float64(5*2048-1)/float64(5*2048), fraction, 1e-9)
+
+	cms, _, err := buildCMSketchAndMap(5, 2048, 0, 1000, 100, 1.1)
+	require.NoError(t, err)
+	count, fraction = cms.SaturatedCounters()
+	require.Equal(t, 0, count)
+	require.Equal(t, 0.0, fraction)
+}
+
+func TestMergePartTopN2GlobalTopNWithBreakdown(t *testing.T) {
+	loc := time.UTC
+	sc := &stmtctx.StatementContext{TimeZone: loc}
+	version := 2
+	isKilled := uint32(0)
+	encode := func(v int64) []byte {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(v))
+		require.NoError(t, err)
+		return key
+	}
+
+	// The value 1 is in the first two TopNs and the last histogram, the value 2 is only in the last TopN.
+	topNs := []*TopN{NewTopN(1), NewTopN(1), NewTopN(1)}
+	topNs[0].AppendTopN(encode(1), 10)
+	topNs[1].AppendTopN(encode(1), 20)
+	topNs[2].AppendTopN(encode(2), 50)
+	hist := NewHistogram(1, 1, 0, 0, types.NewFieldType(mysql.TypeBlob), chunk.InitialCapacity, 0)
+	d := types.NewBytesDatum(encode(1))
+	hist.AppendBucketWithNDV(&d, &d, 7, 7, 1)
+	hists := []*Histogram{nil, nil, hist}
+
+	globalTopN, leftTopN, _, breakdown, err := MergePartTopN2GlobalTopNWithBreakdown(loc, version, topNs, 2, hists, true, &isKilled)
+	require.NoError(t, err)
+	require.Empty(t, leftTopN)
+	require.Equal(t, uint64(87), globalTopN.TotalCount())
+	require.Equal(t, map[string][]uint64{
+		string(encode(1)): {10, 20, 7},
+		string(encode(2)): {0, 0, 50},
+	}, breakdown)
+}
+
+func TestCMSketchInsertHash64(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	bytesSketch := NewCMSketch(d, w)
+	digestSketch := NewCMSketch(d, w)
+	keys := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%20000d", i))
+		keys = append(keys, key)
+		for j := 0; j <= i; j++ {
+			bytesSketch.InsertBytes(key)
+			digestSketch.InsertHash64(murmur3.Sum64(key))
+		}
+	}
+	require.Equal(t, bytesSketch.TotalCount(), digestSketch.TotalCount())
+	mismatched := 0
+	for _, key := range keys {
+		if bytesSketch.QueryBytes(key) != digestSketch.QueryHash64(murmur3.Sum64(key)) {
+			mismatched++
+		}
+	}
+	// The estimations differ only if the values collide in one of the sketches.
+	require.LessOrEqual(t, mismatched, 5)
+}
+
+func TestCMSketchRowEstimates(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	cms := NewCMSketch(d, w)
+	key := []byte("key")
+	cms.InsertBytes(key)
+	require.Equal(t, []uint32{1, 1, 1, 1, 1}, cms.RowEstimates(key))
+
+	// Find a value colliding with the key only in the first row.
+	h1, h2 := murmur3.Sum128(key)
+	var collided []byte
+	for i := 0; collided == nil; i++ {
+		candidate := []byte(fmt.Sprintf("candidate-%d", i))
+		c1, c2 := murmur3.Sum128(candidate)
+		if cellIndex(c1, c2, 0, w) != cellIndex(h1, h2, 0, w) {
+			continue
+		}
+		onlyFirstRow := true
+		for row := 1; row < int(d); row++ {
+			if cellIndex(c1, c2, row, w) == cellIndex(h1, h2, row, w) {
+				onlyFirstRow = false
+			}
+		}
+		if onlyFirstRow {
+			collided = candidate
+		}
+	}
+	cms.InsertBytesByCount(collided, 100)
+	rows := cms.RowEstimates(key)
+	require.Len(t, rows, int(d))
+	require.Equal(t, uint32(101), rows[0])
+	require.Equal(t, []uint32{1, 1, 1, 1}, rows[1:])
+	require.Equal(t, []uint32{101, 100, 100, 100, 100}, cms.RowEstimates(collided))
+}
+
+func TestCMSketchMaxEstimate(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 2)
+	require.NoError(t, err)
+	maxCount := uint32(0)
+	for _, count := range mp {
+		maxCount = mathutil.Max(maxCount, count)
+	}
+	estimate := cms.MaxEstimate()
+	require.GreaterOrEqual(t, estimate, uint64(maxCount))
+	require.InEpsilon(t, maxCount, estimate, 0.01)
+
+	require.Equal(t, uint64(0), NewCMSketch(d, w).MaxEstimate())
+	require.Equal(t, uint64(0), (*CMSketch)(nil).MaxEstimate())
+}
+
+func TestCMSketchSub(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(100000), uint64(1000000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	subSketch := cms.Copy()
+
+	// Delete the first 20000 values, which are generated by the same zipf.
+	deleted := NewCMSketch(d, w)
+	zipf := rand.NewZipf(rand.New(rand.NewSource(0)), 1.1, 1, imax)
+	for i := 0; i < 20000; i++ {
+		val := types.NewIntDatum(int64(zipf.Uint64()))
+		bytes, err := codec.EncodeValue(nil, nil, val)
+		require.NoError(t, err)
+		cms.SubBytes(bytes, 1)
+		deleted.InsertBytes(bytes)
+		mp[val.GetInt64()]--
+		if mp[val.GetInt64()] == 0 {
+			delete(mp, val.GetInt64())
+		}
+	}
+	require.Equal(t, total-20000, cms.TotalCount())
+	avg, err := averageAbsoluteError(cms, nil, mp)
+	require.NoError(t, err)
+	require.LessOrEqual(t, avg, uint64(3))
+
+	require.NoError(t, subSketch.SubCMSketch(deleted))
+	require.True(t, cms.Equal(subSketch))
+	require.Error(t, subSketch.SubCMSketch(NewCMSketch(d, w/2)))
+
+	// The counters saturate at zero.
+	subSketch.SubBytes([]byte("not exists"), 10)
+	require.NoError(t, subSketch.SubCMSketch(cms))
+	require.Equal(t, uint64(0), subSketch.TotalCount())
+	require.Equal(t, uint64(0), subSketch.MaxEstimate())
+}
+
+func TestCMSketchMergeSparse(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	lSketch, _, err := buildCMSketchAndMap(d, w, 0, 100000, 1000000, 1.1)
+	require.NoError(t, err)
+	rSketch, _, err := buildCMSketchAndMap(d, w, 1, 20, 1000000, 1.1)
+	require.NoError(t, err)
+
+	dense, sparse := lSketch.Copy(), lSketch.Copy()
+	require.NoError(t, dense.MergeCMSketch(rSketch))
+	require.NoError(t, sparse.MergeSparse(rSketch))
+	require.True(t, dense.Equal(sparse))
+	require.Equal(t, lSketch.TotalCount()+20, sparse.TotalCount())
+	require.Error(t, sparse.MergeSparse(NewCMSketch(d, w/2)))
+}
+
+// newSparseCMSketchForBench returns a CMSketch whose 95% counters are zero.
+func newSparseCMSketchForBench() *CMSketch {
+	cms := NewCMSketch(5, 2048)
+	for i := range cms.table {
+		for j := 0; j < len(cms.table[i]); j += 20 {
+			cms.table[i][j] = uint32(j + 1)
+		}
+	}
+	cms.count = 2048 / 20
+	return cms
+}
+
+func BenchmarkCMSketchMergeSparse(b *testing.B) {
+	c, rc := NewCMSketch(5, 2048), newSparseCMSketchForBench()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.MergeSparse(rc)
+	}
+}
+
+func BenchmarkCMSketchMergeDense(b *testing.B) {
+	c, rc := NewCMSketch(5, 2048), newSparseCMSketchForBench()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.MergeCMSketch(rc)
+	}
+}
+
+func TestCMSketchAndTopNReset(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	cms, _, err := buildCMSketchAndMap(d, w, 0, 1000, 1000, 1.1)
+	require.NoError(t, err)
+	cms.SetDefaultValue(10)
+	table := cms.table
+	cms.Reset()
+	require.True(t, cms.Equal(NewCMSketch(d, w)))
+	require.Same(t, &table[0][0], &cms.table[0][0])
+
+	topN := NewTopN(10)
+	for i := 0; i < 10; i++ {
+		topN.AppendTopN([]byte{byte(i)}, uint64(i+1))
+	}
+	topN.Pin([]byte{0})
+	topN.Reset()
+	require.True(t, topN.Equal(NewTopN(10)))
+	require.Equal(t, 0, topN.Num())
+	require.Equal(t, 10, cap(topN.TopN))
+	require.False(t, topN.IsPinned([]byte{0}))
+}
+
+func BenchmarkCMSketchNewPerPartition(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for partition := 0; partition < 1000; partition++ {
+			cms := NewCMSketch(5, 2048)
+			cms.InsertBytes([]byte{byte(partition)})
+		}
+	}
+}
+
+func BenchmarkCMSketchResetPerPartition(b *testing.B) {
+	b.ReportAllocs()
+	cms := NewCMSketch(5, 2048)
+	for i := 0; i < b.N; i++ {
+		for partition := 0; partition < 1000; partition++ {
+			cms.Reset()
+			cms.InsertBytes([]byte{byte(partition)})
+		}
+	}
+}
+
+func TestTopNTopValuesForColumn(t *testing.T) {
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	encode := func(a int64, b string) []byte {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(a), types.NewStringDatum(b))
+		require.NoError(t, err)
+		return key
+	}
+	topN := NewTopN(4)
+	topN.AppendTopN(encode(1, "a"), 10)
+	topN.AppendTopN(encode(2, "a"), 5)
+	topN.AppendTopN(encode(1, "b"), 7)
+	topN.AppendTopN(encode(3, "c"), 1)
+	topN.Sort()
+	tps := []*types.FieldType{types.NewFieldType(mysql.TypeLonglong), types.NewFieldType(mysql.TypeVarchar)}
+
+	values, err := topN.TopValuesForColumn(1, 2, tps, time.UTC)
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	require.Equal(t, "a", values[0].GetString())
+	require.Equal(t, "b", values[1].GetString())
+
+	values, err = topN.TopValuesForColumn(0, 10, tps, time.UTC)
+	require.NoError(t, err)
+	require.Len(t, values, 3)
+	require.Equal(t, []int64{1, 2, 3}, []int64{values[0].GetInt64(), values[1].GetInt64(), values[2].GetInt64()})
+
+	_, err = topN.TopValuesForColumn(2, 1, tps, time.UTC)
+	require.Error(t, err)
+	values, err = (*TopN)(nil).TopValuesForColumn(0, 1, tps, time.UTC)
+	require.NoError(t, err)
+	require.Empty(t, values)
+}
+
+func TestSuggestCMSketchDimensions(t *testing.T) {
+	epsilon, delta := 0.001, 0.01
+	d, w := SuggestCMSketchDimensions(epsilon, delta)
+	require.Equal(t, int32(5), d)
+	require.Equal(t, int32(2719), w)
+
+	total, imax := uint64(100000), uint64(1000000)
+	cms, mp, err := buildCMSketchAndMap(d, w, 0, total, imax, 1.1)
+	require.NoError(t, err)
+	avg, err := averageAbsoluteError(cms, nil, mp)
+	require.NoError(t, err)
+	require.LessOrEqual(t, float64(avg), epsilon*float64(total))
+
+	d, w = SuggestCMSketchDimensions(0, 1)
+	require.Equal(t, int32(1), d)
+	require.Equal(t, int32(1<<20), w)
+	d, w = SuggestCMSketchDimensions(1e-9, 0)
+	require.Equal(t, int32(1<<20), d)
+	require.Equal(t, int32(1<<20), w)
+	d, w = SuggestCMSketchDimensions(100, 0.5)
+	require.Equal(t, int32(1), d)
+	require.Equal(t, int32(1), w)
+}
+
+func TestNewCMSketchAuto(t *testing.T) {
+	small, large := NewCMSketchAuto(10000, 1.1), NewCMSketchAuto(100000, 1.1)
+	smallWidth, depth := small.GetWidthAndDepth()
+	largeWidth, _ := large.GetWidthAndDepth()
+	require.Equal(t, int32(5), depth)
+	require.Greater(t, largeWidth, smallWidth)
+	// The skewed data needs a narrower CMSketch.
+	skewedWidth, _ := NewCMSketchAuto(10000, 2).GetWidthAndDepth()
+	require.Less(t, skewedWidth, smallWidth)
+	// The width is clamped.
+	width, _ := NewCMSketchAuto(0, 1.1).GetWidthAndDepth()
+	require.Equal(t, int32(256), width)
+	width, _ = NewCMSketchAuto(math.MaxUint64, 0).GetWidthAndDepth()
+	require.Equal(t, int32(1<<20), width)
+
+	total, expectedDistinct := uint64(100000), uint64(10000)
+	for _, skew := range []float64{1.1, 2} {
+		cms := NewCMSketchAuto(expectedDistinct, skew)
+		mp := make(map[int64]uint32)
+		zipf := rand.NewZipf(rand.New(rand.NewSource(0)), skew, 1, expectedDistinct)
+		for i := uint64(0); i < total; i++ {
+			val := types.NewIntDatum(int64(zipf.Uint64()))
+			require.NoError(t, cms.insert(&val))
+			mp[val.GetInt64()]++
+		}
+		avg, err := averageAbsoluteError(cms, nil, mp)
+		require.NoError(t, err)
+		require.LessOrEqual(t, avg, total/expectedDistinct)
+	}
+}
+
+func TestCMSketchApproxEqual(t *testing.T) {
+	cms, _, err := buildCMSketchAndMap(5, 2048, 0, 10000, 1000, 1.1)
+	require.NoError(t, err)
+	cp := cms.Copy()
+	require.True(t, cms.ApproxEqual(cp, 0))
+	require.Equal(t, cms.Equal(cp), cms.ApproxEqual(cp, 0))
+
+	require.NoError(t, cp.SetCell(0, 0, cms.table[0][0]+2))
+	require.NoError(t, cp.SetCell(4, 2047, cms.table[4][2047]+1))
+	require.False(t, cms.ApproxEqual(cp, 0))
+	require.False(t, cms.ApproxEqual(cp, 1))
+	require.True(t, cms.ApproxEqual(cp, 2))
+	require.True(t, cp.ApproxEqual(cms, 2))
+
+	// One counter exceeds the delta.
+	require.NoError(t, cp.SetCell(2, 100, cms.table[2][100]+10))
+	require.False(t, cms.ApproxEqual(cp, 2))
+	require.True(t, cms.ApproxEqual(cp, 10))
+
+	require.False(t, cms.ApproxEqual(NewCMSketch(5, 1024), math.MaxUint32))
+	require.False(t, cms.ApproxEqual(nil, math.MaxUint32))
+	require.True(t, (*CMSketch)(nil).ApproxEqual(nil, 0))
+}
+
+func TestHeavyHitters(t *testing.T) {
+	d, w := int32(5), int32(2048)
+	total, imax := uint64(1000000), uint64(1000000)
+	cms, topN, mp, err := buildCMSketchTopNAndMap(d, w, 20, 1000, 0, total, imax, 2)
+	require.NoError(t, err)
+	threshold := uint64(100000)
+	hitters, residual := HeavyHitters(cms, topN, threshold)
+
+	expected := make([]int64, 0, 2)
+	for val, count := range mp {
+		if uint64(count) > threshold {
+			expected = append(expected, val)
+		}
+	}
+	require.NotEmpty(t, expected)
+	actual := make([]int64, 0, len(hitters))
+	for i, hitter := range hitters {
+		require.Greater(t, hitter.Count, threshold)
+		if i > 0 {
+			require.GreaterOrEqual(t, hitters[i-1].Count, hitter.Count)
+		}
+		_, datum, err := codec.DecodeOne(hitter.Encoded)
+		require.NoError(t, err)
+		actual = append(actual, datum.GetInt64())
+	}
+	require.ElementsMatch(t, expected, actual)
+	hittersCount := uint64(0)
+	for _, hitter := range hitters {
+		hittersCount += hitter.Count
+	}
+	require.Equal(t, cms.TotalCount()+topN.TotalCount(), hittersCount+residual)
+
+	hitters, residual = HeavyHitters(cms, nil, threshold)
+	require.Empty(t, hitters)
+	require.Equal(t, cms.TotalCount(), residual)
+}
+
+func TestCMSketchSetCell(t *testing.T) {
+	d, w := int32(5), int32(64)
+	cms := NewCMSketch(d, w)
+	key := []byte("key")
+	h1, h2 := murmur3.Sum128(key)
+	for row := int32(0); row < d; row++ {
+		col := int32(cellIndex(h1, h2, int(row), w))
+		require.NoError(t, cms.SetCell(row, col, uint32(10+row)))
+	}
+	require.Equal(t, []uint32{10, 11, 12, 13, 14}, cms.RowEstimates(key))
+	// The count is not changed until it is recomputed.
+	require.Equal(t, uint64(0), cms.TotalCount())
+	cms.RepairCount()
+	require.Equal(t, uint64(12), cms.TotalCount())
+	require.Equal(t, uint64(10), cms.QueryBytes(key))
+
+	require.Error(t, cms.SetCell(d, 0, 1))
+	require.Error(t, cms.SetCell(0, w, 1))
+	require.Error(t, cms.SetCell(-1, 0, 1))
+}
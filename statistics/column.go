@@ -110,6 +110,45 @@ func (c *Column) MemoryUsage() CacheItemMemoryUsage {
 	return columnMemUsage
 }
 
+// StatsMemoryUsage returns the total memory usage of the CMSketch, TopN and Histogram of a column or an index,
+// any of them can be nil.
+func StatsMemoryUsage(cms *CMSketch, topN *TopN, hist *Histogram) int64 {
+	return cms.MemoryUsage() + topN.MemoryUsage() + hist.MemoryUsage()
+}
+
+// EstimateColumnNDVFromStats combines the TopN, Histogram and CMSketch of a column or an index into a single NDV
+// estimation, any of them can be nil. The values in TopN are counted by the TopN, and the rest values are estimated
+// by the larger one of the histogram NDV and the linear counting of the CMSketch. A TopN value which is also the
+// upper bound of a bucket is counted by the histogram too, so it is subtracted from the histogram NDV. The bounds
+// are compared with the TopN values in their raw bytes as RemoveVals does. Since the NULL values are inserted into
+// the CMSketch but neither TopN nor Histogram counts them, the NULL is excluded from the CMSketch estimation when
+// nullCount is positive.
+func EstimateColumnNDVFromStats(cms *CMSketch, topN *TopN, hist *Histogram, nullCount int64) int64 {
+	topNNDV := int64(topN.Num())
+	var histNDV int64
+	if hist != nil {
+		histNDV = hist.NDV
+		if topNNDV > 0 && hist.Len() > 0 {
+			upperBounds := make(map[string]struct{}, hist.Len())
+			for i := 0; i < hist.Len(); i++ {
+				if hist.Buckets[i].Repeat > 0 {
+					upperBounds[string(hist.Bounds.Column(0).GetRaw(i*2+1))] = struct{}{}
+				}
+			}
+			for _, meta := range topN.TopN {
+				if _, ok := upperBounds[string(meta.Encoded)]; ok {
+					histNDV--
+				}
+			}
+		}
+	}
+	sketchNDV := cms.ApproxKeyCount()
+	if sketchNDV > 0 && nullCount > 0 {
+		sketchNDV--
+	}
+	return topNNDV + mathutil.Max(histNDV, sketchNDV, 0)
+}
+
 // HistogramNeededItems stores the columns/indices whose Histograms need to be loaded from physical kv layer.
 // Currently, we only load index/pk's Histogram from kv automatically. Columns' are loaded by needs.
 var HistogramNeededItems = neededStatsMap{items: map[model.TableItemID]struct{}{}}
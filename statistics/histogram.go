@@ -501,6 +501,99 @@ func (hg *Histogram) BetweenRowCount(sctx sessionctx.Context, a, b types.Datum)
 	return lessCountB - lessCountA
 }
 
+// BetweenSelectivity estimates the selectivity of `BETWEEN low AND high`, both bounds are inclusive.
+// The row count is the sum of the TopN values in the range and the row count estimated by the histogram,
+// so the histogram should not contain the TopN values, as the one of the stats version 2.
+func BetweenSelectivity(sc *stmtctx.StatementContext, topN *TopN, hist *Histogram, totalCount uint64, low, high types.Datum) (float64, error) {
+	cmp, err := low.Compare(sc, &high, collate.GetBinaryCollator())
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if cmp > 0 {
+		return 0, errors.New("the lower bound of BETWEEN is larger than the upper bound")
+	}
+	if totalCount == 0 {
+		return 0, nil
+	}
+	lowKey, err := codec.EncodeKey(sc, nil, low)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	highKey, err := codec.EncodeKey(sc, nil, high)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	count := float64(0)
+	if topN != nil {
+		lIdx, _ := topN.LowerBound(lowKey)
+		rIdx, match := topN.LowerBound(highKey)
+		if match {
+			rIdx++
+		}
+		for i := lIdx; i < rIdx; i++ {
+			count += float64(topN.TopN[i].Count)
+		}
+	}
+	if hist != nil && hist.Len() > 0 {
+		if cmp < 0 {
+			count += hist.BetweenRowCount(nil, low, high)
+		}
+		equalCount, _ := hist.equalRowCount(nil, high, false)
+		count += equalCount
+	}
+	return math.Max(0, math.Min(1, count/float64(totalCount))), nil
+}
+
+// LikePrefixSelectivity estimates the selectivity of `col LIKE 'prefix%'` on a string column, which is the range
+// [prefix, next) where next is the smallest string larger than all the strings with the prefix, the range is not
+// bounded above if there is no such string, e.g. for the empty prefix. The row count is the sum of the TopN values in
+// the range and the row count estimated by the histogram like BetweenSelectivity.
+func LikePrefixSelectivity(sc *stmtctx.StatementContext, topN *TopN, hist *Histogram, totalCount uint64, prefix string, tp *types.FieldType) (float64, error) {
+	if !types.IsString(tp.GetType()) {
+		return 0, errors.Errorf("LIKE prefix selectivity is not supported for the type %s", tp.String())
+	}
+	if totalCount == 0 {
+		return 0, nil
+	}
+	low := types.NewStringDatum(prefix)
+	next := []byte(prefix)
+	for len(next) > 0 && next[len(next)-1] == 0xFF {
+		next = next[:len(next)-1]
+	}
+	bounded := len(next) > 0
+	if bounded {
+		next[len(next)-1]++
+	}
+	high := types.NewBytesDatum(next)
+	lowKey, err := codec.EncodeKey(sc, nil, low)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	highKey, err := codec.EncodeKey(sc, nil, high)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	count := float64(0)
+	if topN != nil {
+		lIdx, _ := topN.LowerBound(lowKey)
+		rIdx := len(topN.TopN)
+		if bounded {
+			rIdx, _ = topN.LowerBound(highKey)
+		}
+		for i := lIdx; i < rIdx; i++ {
+			count += float64(topN.TopN[i].Count)
+		}
+	}
+	if hist != nil && hist.Len() > 0 {
+		if bounded {
+			count += hist.BetweenRowCount(nil, low, high)
+		} else {
+			count += hist.notNullCount() - hist.lessRowCount(nil, low)
+		}
+	}
+	return math.Max(0, math.Min(1, count/float64(totalCount))), nil
+}
+
 // TotalRowCount returns the total count of this histogram.
 func (hg *Histogram) TotalRowCount() float64 {
 	return hg.notNullCount() + float64(hg.NullCount)
@@ -789,6 +882,65 @@ func MergeHistograms(sc *stmtctx.StatementContext, lh *Histogram, rh *Histogram,
 	return lh, nil
 }
 
+// MergeHistogramsWithCast merges two histograms whose field types may be different but compatible.
+// The histogram of the narrower type is converted to the wider type by the StatementContext before
+// the bounds are merged, e.g. merging a TINYINT and a SMALLINT histogram results in a SMALLINT one.
+// The unsafe conversions, such as between signed and unsigned integers or between numbers and strings,
+// are rejected.
+func MergeHistogramsWithCast(sc *stmtctx.StatementContext, lh *Histogram, rh *Histogram, bucketSize int, statsVer int) (*Histogram, error) {
+	tp := widerHistogramType(lh.Tp, rh.Tp)
+	if tp == nil {
+		return nil, errors.Errorf("can not merge histograms of type %v and %v", lh.Tp, rh.Tp)
+	}
+	var err error
+	if lh.Tp.GetType() != tp.GetType() {
+		lh, err = lh.ConvertTo(sc, tp)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if rh.Tp.GetType() != tp.GetType() {
+		rh, err = rh.ConvertTo(sc, tp)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return MergeHistograms(sc, lh, rh, bucketSize, statsVer)
+}
+
+// widerHistogramType returns the wider one of the two types if the values of the narrower one
+// can be promoted to it without loss, otherwise nil is returned.
+func widerHistogramType(l, r *types.FieldType) *types.FieldType {
+	if mysql.HasUnsignedFlag(l.GetFlag()) != mysql.HasUnsignedFlag(r.GetFlag()) {
+		return nil
+	}
+	if l.GetType() == r.GetType() {
+		return l
+	}
+	ranks := map[byte]int{
+		mysql.TypeTiny:     1,
+		mysql.TypeShort:    2,
+		mysql.TypeInt24:    3,
+		mysql.TypeLong:     4,
+		mysql.TypeLonglong: 5,
+	}
+	if !mysql.IsIntegerType(l.GetType()) || !mysql.IsIntegerType(r.GetType()) {
+		ranks = map[byte]int{
+			mysql.TypeFloat:  1,
+			mysql.TypeDouble: 2,
+		}
+	}
+	lRank, lOK := ranks[l.GetType()]
+	rRank, rOK := ranks[r.GetType()]
+	if !lOK || !rOK {
+		return nil
+	}
+	if lRank > rRank {
+		return l
+	}
+	return r
+}
+
 // AvgCountPerNotNullValue gets the average row count per value by the data of histogram.
 func (hg *Histogram) AvgCountPerNotNullValue(totalCount int64) float64 {
 	factor := hg.GetIncreaseFactor(totalCount)
@@ -489,3 +489,120 @@ func TestIndexQueryBytes(t *testing.T) {
 	// Repeat
 	require.Equal(t, idx.QueryBytes(nil, high), uint64(10))
 }
+
+func TestMergeHistogramsWithCast(t *testing.T) {
+	sc := mock.NewContext().GetSessionVars().StmtCtx
+	tinyTp := types.NewFieldType(mysql.TypeTiny)
+	shortTp := types.NewFieldType(mysql.TypeShort)
+	genHist := func(tp *types.FieldType, bounds [][2]int64, counts []int64) *Histogram {
+		h := NewHistogram(1, int64(len(bounds)), 0, 0, tp, len(bounds), 0)
+		for i, b := range bounds {
+			lower, upper := types.NewIntDatum(b[0]), types.NewIntDatum(b[1])
+			h.AppendBucket(&lower, &upper, counts[i], 1)
+		}
+		return h
+	}
+
+	lh := genHist(tinyTp, [][2]int64{{1, 1}, {2, 3}}, []int64{2, 5})
+	rh := genHist(shortTp, [][2]int64{{300, 300}, {400, 500}}, []int64{3, 8})
+	h, err := MergeHistogramsWithCast(sc, lh, rh, 10, Version1)
+	require.NoError(t, err)
+	require.Equal(t, mysql.TypeShort, h.Tp.GetType())
+	require.Equal(t, 4, h.Len())
+	require.Equal(t, int64(4), h.NDV)
+	require.Equal(t, int64(1), h.GetLower(0).GetInt64())
+	require.Equal(t, int64(500), h.GetUpper(3).GetInt64())
+	require.Equal(t, int64(13), h.Buckets[3].Count)
+
+	// Signed and unsigned integers can't be merged safely.
+	unsignedTp := types.NewFieldType(mysql.TypeTiny)
+	unsignedTp.AddFlag(mysql.UnsignedFlag)
+	lh = genHist(unsignedTp, [][2]int64{{1, 1}}, []int64{2})
+	rh = genHist(shortTp, [][2]int64{{300, 300}}, []int64{3})
+	_, err = MergeHistogramsWithCast(sc, lh, rh, 10, Version1)
+	require.Error(t, err)
+	// Even if the types are the same.
+	rh = genHist(tinyTp, [][2]int64{{-1, -1}}, []int64{3})
+	_, err = MergeHistogramsWithCast(sc, lh, rh, 10, Version1)
+	require.Error(t, err)
+
+	// Integers and strings can't be merged safely.
+	rh = NewHistogram(1, 1, 0, 0, types.NewFieldType(mysql.TypeVarchar), 1, 0)
+	lower, upper := types.NewStringDatum("a"), types.NewStringDatum("b")
+	rh.AppendBucket(&lower, &upper, 1, 1)
+	_, err = MergeHistogramsWithCast(sc, genHist(tinyTp, [][2]int64{{1, 1}}, []int64{2}), rh, 10, Version1)
+	require.Error(t, err)
+}
+
+func TestBetweenSelectivity(t *testing.T) {
+	sc := mock.NewContext().GetSessionVars().StmtCtx
+	hist := NewHistogram(1, 5, 0, 0, types.NewFieldType(mysql.TypeTiny), 3, 0)
+	for _, b := range []struct{ lower, upper, count int64 }{{1, 1, 10}, {2, 3, 30}, {4, 5, 50}} {
+		lower, upper := types.NewIntDatum(b.lower), types.NewIntDatum(b.upper)
+		hist.AppendBucket(&lower, &upper, b.count, 10)
+	}
+	topN := NewTopN(2)
+	for _, v := range []struct{ val, count int64 }{{3, 20}, {7, 100}} {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(v.val))
+		require.NoError(t, err)
+		topN.AppendTopN(key, uint64(v.count))
+	}
+	topN.Sort()
+
+	// The histogram has 30 rows in [1, 3] and the TopN has 20 rows.
+	sel, err := BetweenSelectivity(sc, topN, hist, 170, types.NewIntDatum(1), types.NewIntDatum(3))
+	require.NoError(t, err)
+	require.InDelta(t, float64(50)/170, sel, 1e-9)
+
+	sel, err = BetweenSelectivity(sc, topN, hist, 170, types.NewIntDatum(3), types.NewIntDatum(3))
+	require.NoError(t, err)
+	require.InDelta(t, float64(30)/170, sel, 1e-9)
+
+	sel, err = BetweenSelectivity(sc, nil, hist, 170, types.NewIntDatum(6), types.NewIntDatum(10))
+	require.NoError(t, err)
+	require.Equal(t, float64(0), sel)
+
+	_, err = BetweenSelectivity(sc, topN, hist, 170, types.NewIntDatum(3), types.NewIntDatum(1))
+	require.Error(t, err)
+}
+
+func TestLikePrefixSelectivity(t *testing.T) {
+	sc := mock.NewContext().GetSessionVars().StmtCtx
+	tp := types.NewFieldType(mysql.TypeVarchar)
+	hist := NewHistogram(1, 4, 0, 0, tp, 2, 0)
+	for _, b := range []struct {
+		lower, upper string
+		count        int64
+	}{{"a", "az", 20}, {"b", "bz", 50}} {
+		lower, upper := types.NewStringDatum(b.lower), types.NewStringDatum(b.upper)
+		hist.AppendBucket(&lower, &upper, b.count, 5)
+	}
+	hist.PreCalculateScalar()
+	topN := NewTopN(2)
+	for _, v := range []struct {
+		val   string
+		count int64
+	}{{"aa", 15}, {"c", 40}} {
+		key, err := codec.EncodeKey(sc, nil, types.NewStringDatum(v.val))
+		require.NoError(t, err)
+		topN.AppendTopN(key, uint64(v.count))
+	}
+	topN.Sort()
+
+	// The histogram has 20 rows in ["a", "b") and the TopN has 15 rows.
+	sel, err := LikePrefixSelectivity(sc, topN, hist, 105, "a", tp)
+	require.NoError(t, err)
+	require.InDelta(t, float64(35)/105, sel, 1e-9)
+
+	sel, err = LikePrefixSelectivity(sc, topN, hist, 105, "c", tp)
+	require.NoError(t, err)
+	require.InDelta(t, float64(40)/105, sel, 1e-9)
+
+	// The empty prefix matches all the rows.
+	sel, err = LikePrefixSelectivity(sc, topN, hist, 105, "", tp)
+	require.NoError(t, err)
+	require.InDelta(t, 1, sel, 1e-9)
+
+	_, err = LikePrefixSelectivity(sc, topN, hist, 105, "a", types.NewFieldType(mysql.TypeLong))
+	require.Error(t, err)
+}
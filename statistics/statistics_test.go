@@ -714,3 +714,54 @@ func TestPruneTopN(t *testing.T) {
 	topnOut = pruneTopNItem(topnIn, totalNDV, nullCnt, sampleRows, totalRows)
 	require.Equal(t, topnIn, topnOut)
 }
+
+func TestStatsMemoryUsage(t *testing.T) {
+	cms := NewCMSketch(5, 2048)
+	topN := NewTopN(2)
+	// The capacities of the encoded values are counted.
+	topN.AppendTopN([]byte{'a'}, 10)
+	topN.AppendTopN([]byte{'b', 'c'}, 20)
+	hist := mockHistogram(0, 10)
+
+	require.Equal(t, int64(5*2048*4), cms.MemoryUsage())
+	require.Equal(t, int64(32+(32+1)+(32+2)), topN.MemoryUsage())
+	require.Equal(t, cms.MemoryUsage()+topN.MemoryUsage()+hist.MemoryUsage(), StatsMemoryUsage(cms, topN, hist))
+	require.Equal(t, hist.MemoryUsage(), StatsMemoryUsage(nil, nil, hist))
+	require.Equal(t, int64(0), StatsMemoryUsage(nil, nil, nil))
+}
+
+func TestEstimateColumnNDVFromStats(t *testing.T) {
+	sc := &stmtctx.StatementContext{TimeZone: time.Local}
+	encode := func(i int64) []byte {
+		key, err := codec.EncodeKey(sc, nil, types.NewIntDatum(i))
+		require.NoError(t, err)
+		return key
+	}
+	// The unique values [0, 1000) are in the CMSketch, and NULL is inserted too.
+	cms := NewCMSketch(5, 2048)
+	for i := int64(0); i < 1000; i++ {
+		cms.InsertBytes(encode(i))
+	}
+	nullKey, err := codec.EncodeKey(sc, nil, types.NewDatum(nil))
+	require.NoError(t, err)
+	cms.InsertBytesByCount(nullKey, 5)
+	// The values [1000, 1010) are in the TopN.
+	topN := NewTopN(10)
+	for i := int64(1000); i < 1010; i++ {
+		topN.AppendTopN(encode(i), 100)
+	}
+	// The histogram holds the values [0, 1000) and the TopN value 1000 as the upper bound of the last bucket.
+	hist := NewHistogram(0, 1001, 5, 0, types.NewFieldType(mysql.TypeBlob), 2, 0)
+	lower, upper := types.NewBytesDatum(encode(0)), types.NewBytesDatum(encode(499))
+	hist.AppendBucket(&lower, &upper, 500, 1)
+	lower, upper = types.NewBytesDatum(encode(500)), types.NewBytesDatum(encode(1000))
+	hist.AppendBucket(&lower, &upper, 1100, 100)
+
+	require.Equal(t, int64(1010), EstimateColumnNDVFromStats(nil, topN, hist, 5))
+	ndv := EstimateColumnNDVFromStats(cms, topN, nil, 5)
+	require.InEpsilon(t, 1010, ndv, 0.05)
+	ndv = EstimateColumnNDVFromStats(cms, topN, hist, 5)
+	require.InEpsilon(t, 1010, ndv, 0.05)
+	require.GreaterOrEqual(t, ndv, int64(1010))
+	require.Equal(t, int64(0), EstimateColumnNDVFromStats(nil, nil, nil, 0))
+}
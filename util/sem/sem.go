@@ -144,6 +144,10 @@ func IsInvisibleSysVar(varNameInLower string) bool {
 		variable.TiDBForcePriority,
 		variable.TiDBGeneralLog,
 		variable.TiDBMetricSchemaRangeDuration,
+		variable.TiDBMetricSchemaExtraLabelConditions,
+		variable.TiDBMetricSchemaOffset,
+		variable.TiDBMetricSchemaErrorAsRow,
+		variable.TiDBMetricSchemaMaxPromQLLen,
 		variable.TiDBMetricSchemaStep,
 		variable.TiDBOptWriteRowID,
 		variable.TiDBPProfSQLCPU,